@@ -62,10 +62,17 @@ func registerAccessLogFile(name, filename string, handler accesslog.DynamicLogHa
 	registry[name] = &activeAccesslog{name: name, filename: filename, writer: w, handler: handler}
 }
 
-func unregisterAccessLogFile(name string, w io.Writer) {
+// unregisterAccessLogFile removes the access log of the handler from the registry and
+// returns its current writer.
+func unregisterAccessLogFile(name string, handler accesslog.DynamicLogHandler) (w io.WriteCloser) {
 	registryLock.Lock()
 	defer registryLock.Unlock()
-	delete(registry, name)
+	// A server rebuilt on reload has already registered its new access log by the same name.
+	if spec, ok := registry[name]; ok && spec.handler == handler {
+		w = spec.writer
+		delete(registry, name)
+	}
+	return
 }
 
 // wrapAuditHandler takes an http.Handler and wraps it in a accesslog capable handler which also does a callback to the provided audit function.
@@ -93,8 +100,11 @@ func wrapAuditHandler(servername string, h http.Handler, accessLogDest string, m
 		registerAccessLogFile(servername, accessLogDest, oh, out)
 		oh.ToggleAccessLog(nil, out)
 		cleanup = func() error {
+			// The file might have been reopened since.
+			if w := unregisterAccessLogFile(servername, oh); w != nil {
+				out = w
+			}
 			oh.ToggleAccessLog(out, nil)
-			unregisterAccessLogFile(servername, out)
 			log.INFO("Closing logfile", "file", accessLogDest)
 			return out.Close()
 		}
@@ -0,0 +1,157 @@
+package ozone
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/One-com/gone/metric"
+)
+
+var errBodyTooLarge = errors.New("Request body too large")
+
+// bodyLimitHandler rejects requests with bodies larger than max with a 413 response.
+// Requests announcing a larger Content-Length are rejected before calling the handler.
+// Otherwise the handler gets an error reading beyond the limit, and the response is
+// the 413 if the handler hasn't responded yet. The handler's response is discarded.
+// The body may be read by other goroutines (like the transport of a proxy), so the 413
+// is only written by the goroutines writing the response - or when the handler returns.
+type bodyLimitHandler struct {
+	handler  http.Handler
+	max      int64
+	errBody  string
+	rejected *metric.Counter // counts rejected requests - if not nil
+}
+
+// limitRequestBody wraps a handler limiting request bodies to max bytes - if max is not 0.
+// Rejected requests are counted by the rejected counter if not nil.
+func limitRequestBody(h http.Handler, max int64, errBody string, rejected *metric.Counter) http.Handler {
+	if max == 0 {
+		return h
+	}
+	if errBody == "" {
+		errBody = http.StatusText(http.StatusRequestEntityTooLarge) + "\n"
+	}
+	return &bodyLimitHandler{handler: h, max: max, errBody: errBody, rejected: rejected}
+}
+
+func (h *bodyLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > h.max {
+		h.reject(w)
+		return
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+	body := &limitedBody{ReadCloser: r.Body, remaining: h.max}
+	lw := &bodyLimitWriter{ResponseWriter: w, limit: h, body: body}
+	r.Body = body
+	h.handler.ServeHTTP(lw, r)
+	lw.finish()
+}
+
+func (h *bodyLimitHandler) reject(w http.ResponseWriter) {
+	if h.rejected != nil {
+		h.rejected.Inc(1)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(h.errBody)))
+	// The rest of the body is not read, so the connection can't be reused.
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	io.WriteString(w, h.errBody)
+}
+
+// limitedBody fails reading beyond the limit - recording that the body is too large.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  int32 // atomic - set when reading beyond the limit
+}
+
+func (b *limitedBody) Read(p []byte) (n int, err error) {
+	if b.remaining < 0 {
+		return 0, errBodyTooLarge
+	}
+	// Read one more byte than allowed to tell whether the body is too large.
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err = b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = -1
+		atomic.StoreInt32(&b.exceeded, 1)
+		return n, errBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return
+}
+
+func (b *limitedBody) tooLarge() bool {
+	return atomic.LoadInt32(&b.exceeded) != 0
+}
+
+// bodyLimitWriter responds 413 instead of the response of the handler when the body
+// turns out to be too large before the handler has responded.
+type bodyLimitWriter struct {
+	http.ResponseWriter
+	limit       *bodyLimitHandler
+	body        *limitedBody
+	wroteHeader bool
+	rejected    bool
+}
+
+// respond writes the 413 instead of the response of the handler if the body is too large.
+// It tells whether the response of the handler is to be written.
+func (w *bodyLimitWriter) respond() bool {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		if w.body.tooLarge() {
+			w.rejected = true
+			w.limit.reject(w.ResponseWriter)
+		}
+	}
+	return !w.rejected
+}
+
+// finish responds 413 if the body is too large and the handler returned without responding.
+func (w *bodyLimitWriter) finish() {
+	if !w.wroteHeader && w.body.tooLarge() {
+		w.respond()
+	}
+}
+
+func (w *bodyLimitWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	if w.respond() {
+		w.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (w *bodyLimitWriter) Write(b []byte) (int, error) {
+	if !w.respond() {
+		return 0, errBodyTooLarge
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *bodyLimitWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.respond() {
+		f.Flush()
+	}
+}
+
+func (w *bodyLimitWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("Hijacking not supported")
+}
@@ -2,15 +2,17 @@ package config
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 
 	"github.com/pkg/errors"
 
 	"github.com/One-com/gone/jconf"
 
+	"github.com/One-com/ozone/v2/proxyproto"
 	"github.com/One-com/ozone/v2/tlsconf"
 )
 
@@ -29,13 +31,55 @@ type TLSServerConfig struct {
 }
 
 // ListenerConfig defined the JSON used to configure a listener.
+// Network is "tcp" (the default), "tcp4", "tcp6" or "unix". TCP listeners listen on Address and Port.
+// UNIX socket listeners listen on Path - an abstract socket if it starts with "@". The socket file
+// is given Mode (octal, like "0660") and Owner ("user" or "user:group") if set. With a Mode it's only
+// accessible by the owner until then - on Linux. The file is removed when the listener is no longer configured.
+//
+// TCP listeners can have socket options set. With ReusePort a number of Acceptors (default 1) listen
+// on the same address with SO_REUSEPORT, letting the kernel spread connections between them.
+// KeepAlive is the keepalive period of connections (negative disables keepalives) and NoDelay sets
+// TCP_NODELAY (on by default). DeferAccept (TCP_DEFER_ACCEPT), FastOpen (the TCP Fast Open queue length),
+// Backlog and the ReadBuffer/WriteBuffer sizes are set on the listening socket - also when inherited.
+// Options other than KeepAlive and NoDelay are only supported on Linux.
+//
+// MaxConnections limits the concurrent connections of the listener. Accepting more is delayed until
+// connections are closed. Connections from a client IP beyond MaxConnectionsPerIP are closed.
+// MaxConnectionsPerIP can't be used with ProxyProtocol, since the client IP is only known after
+// accepting the connection - nor on UNIX sockets, which have no client IP.
+//
+// Connections transferring data slower than MinReadRate or MinWriteRate (bytes/sec) while serving
+// requests are closed. The rates are measured over MinRateWindow (default 10s) from the request
+// headers having been read, so slow headers are left to ReadHeaderTimeout. HTTP/2 connections are
+// not checked.
 type ListenerConfig struct {
+	Network           string `json:",omitempty"`
 	Address           string
 	Port              int
-	IOActivityTimeout jconf.Duration   `json:",omitempty"`
-	TLS               *TLSServerConfig `json:",omitempty"`
-	SocketFdName      string           `json:",omitempty"`
-	SocketInheritOnly bool             `json:",omitempty"`
+	Path              string             `json:",omitempty"`
+	Mode              string             `json:",omitempty"`
+	Owner             string             `json:",omitempty"`
+	IOActivityTimeout jconf.Duration     `json:",omitempty"`
+	ProxyProtocol     *proxyproto.Config `json:",omitempty"`
+	TLS               *TLSServerConfig   `json:",omitempty"`
+	SocketFdName      string             `json:",omitempty"`
+	SocketInheritOnly bool               `json:",omitempty"`
+	ReusePort         bool               `json:",omitempty"`
+	Acceptors         int                `json:",omitempty"`
+	Backlog           int                `json:",omitempty"`
+	ReadBuffer        int                `json:",omitempty"`
+	WriteBuffer       int                `json:",omitempty"`
+	KeepAlive         jconf.Duration     `json:",omitempty"`
+	NoDelay           *bool              `json:",omitempty"`
+	DeferAccept       jconf.Duration     `json:",omitempty"`
+	FastOpen          int                `json:",omitempty"`
+
+	MaxConnections      int `json:",omitempty"`
+	MaxConnectionsPerIP int `json:",omitempty"`
+
+	MinReadRate   int            `json:",omitempty"`
+	MinWriteRate  int            `json:",omitempty"`
+	MinRateWindow jconf.Duration `json:",omitempty"`
 }
 
 // HTTPServerConfig defines the JSON to configure a HTTP server.
@@ -49,6 +93,7 @@ type HTTPServerConfig struct {
 	AccessLog string
 
 	// a , separated string of return code specs: "2XX,412,5XX,404"
+	// and "time", "size" or "toolarge" (requests rejected by MaxRequestBody)
 	Metrics string
 
 	DisableKeepAlives bool
@@ -59,22 +104,75 @@ type HTTPServerConfig struct {
 	WriteTimeout      jconf.Duration
 
 	NewActiveTimeout jconf.Duration
+
+	// Limits of request header and body size. Requests with larger bodies get a
+	// 413 response with MaxRequestBodyError as body.
+	MaxHeaderBytes      int    `json:",omitempty"`
+	MaxRequestBody      int64  `json:",omitempty"`
+	MaxRequestBodyError string `json:",omitempty"`
+
+	// HTTP/2 of the server. If not set, HTTP/2 is whatever Go does by default.
+	HTTP2 *HTTP2Config `json:",omitempty"`
+
+	// Middleware wrapping the handler of the server - the first seeing requests first.
+	Middleware []MiddlewareConfig `json:",omitempty"`
 }
 
-// RedirectHandlerConfig is configuration for a 30X redirect handler
+// MiddlewareConfig specifies the type and config of a middleware wrapping a handler.
+type MiddlewareConfig struct {
+	Type   string
+	Config *jconf.OptionalSubConfig `json:",omitempty"`
+}
+
+// HTTP2Config defines the JSON to configure HTTP/2 of a HTTP server.
+// HTTP/2 is negotiated on TLS listeners unless disabled. Cleartext HTTP/2 (h2c) - with prior
+// knowledge or by upgrade - is only served on non-TLS listeners if enabled.
+type HTTP2Config struct {
+	Disable                      bool           `json:",omitempty"`
+	H2C                          bool           `json:",omitempty"`
+	MaxConcurrentStreams         uint32         `json:",omitempty"`
+	MaxReadFrameSize             uint32         `json:",omitempty"`
+	MaxUploadBufferPerConnection int32          `json:",omitempty"`
+	MaxUploadBufferPerStream     int32          `json:",omitempty"`
+	IdleTimeout                  jconf.Duration `json:",omitempty"`
+	PermitProhibitedCipherSuites bool           `json:",omitempty"`
+}
+
+// RedirectHandlerConfig is configuration for a 30X redirect handler.
+// URLs are templates which can refer to the request by "{scheme}", "{host}", "{hostname}" (host
+// without port), "{path}" and "{query}" ("?" and the query - or nothing) and to the groups captured by
+// the Host and Path regular expressions of a rule by name. Groups of Path can also be used by number ("{1}").
+// Rules are tried in order. Requests matching no rule are redirected to URL - or get a 404 if not set.
+// Without Rules a URL with other variables than those of the request is not a template, but used as is.
+// Code defaults to 302.
 type RedirectHandlerConfig struct {
-	Code int
+	Code  int                  `json:",omitempty"`
+	URL   string               `json:",omitempty"`
+	Rules []RedirectRuleConfig `json:",omitempty"`
+}
+
+// RedirectRuleConfig redirects requests matching the Host and Path regular expressions (if given)
+// to URL with Code (default the Code of the handler). Host matches all of the host name (without port)
+// case insensitively. Path matches the escaped path.
+type RedirectRuleConfig struct {
+	Host string `json:",omitempty"`
+	Path string `json:",omitempty"`
 	URL  string
+	Code int `json:",omitempty"`
 }
 
 // HandlerConfig specifies the type and config for a handler.
 // Potentiall found in a plugin.
-// All handlers can be wrapped in metrics spec specific for them.
+// All handlers can be wrapped in metrics spec specific for them, in middleware
+// and can limit the size of request bodies like servers.
 type HandlerConfig struct {
-	Type    string
-	Plugin  string
-	Metrics string                   `json:",omitempty"`
-	Config  *jconf.OptionalSubConfig `json:",omitempty"`
+	Type                string
+	Plugin              string
+	Metrics             string                   `json:",omitempty"`
+	MaxRequestBody      int64                    `json:",omitempty"`
+	MaxRequestBodyError string                   `json:",omitempty"`
+	Middleware          []MiddlewareConfig       `json:",omitempty"`
+	Config              *jconf.OptionalSubConfig `json:",omitempty"`
 }
 
 // TLSPluginConfig defines configuration for loading and configuring
@@ -98,6 +196,26 @@ type HTTPServersConfig map[string]HTTPServerConfig
 type HandlersConfig map[string]HandlerConfig
 type TLSPluginsConfig map[string]TLSPluginConfig
 
+// Names returns the names of the configured servers in sorted order.
+func (c HTTPServersConfig) Names() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Names returns the names of the configured handlers in sorted order.
+func (c HandlersConfig) Names() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 type LogConfig struct {
 	AccessLog string
 }
@@ -111,53 +229,105 @@ type Config struct {
 	SNI          *jconf.OptionalSubConfig `json:"SNI,omitempty"` // a special backwards compatible option
 	TLSPlugins   TLSPluginsConfig         `json:",omitempty"`
 	TLSPluginDir string                   `json:",omitempty"`
+
+	// Files (or directories) to merge into this config. Glob patterns are allowed.
+	// Relative paths are relative to the directory of the including file.
+	// Include is consumed while loading, so it's never part of a merged config.
+	Include []string `json:",omitempty"`
+
+	files   []string   // all files the config was loaded from.
+	dirs    []string   // directories all config files were loaded from.
+	secrets [][]string // paths of the values secrets were substituted into.
 }
 
-// Dump serialized the JSON config as configured to standard output
-func (cfg *Config) Dump(dest io.Writer) {
+// Files returns the names of all files the config was loaded from - the config file
+// itself and all included files. It's empty for configs not loaded from files.
+func (cfg *Config) Files() []string {
+	return cfg.files
+}
 
-	var out bytes.Buffer
-	b, err := json.Marshal(cfg)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
+// Dirs returns the directories from which all config files were loaded - either given
+// as the config or by "Include".
+func (cfg *Config) Dirs() []string {
+	return cfg.dirs
+}
 
-	err = json.Indent(&out, b, "", "    ")
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-	_, err = out.Write([]byte("\n"))
+// Dump serialized the JSON config as configured to standard output.
+// Secret values substituted from files and credentials are redacted.
+func (cfg *Config) Dump(dest io.Writer) {
+	err := cfg.DumpFormat(dest, FormatJSON)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		return
 	}
-	out.WriteTo(dest)
 }
 
 // ParseConfigFromFile returns a pointer to a new Config object
 // after parsing config file content.
+// If filename is a directory, all config files in it are merged in lexical order.
+// Any files referenced by "Include" are merged into the config.
+// The format of each file is given by its extension. Files with other extensions are JSON.
 func ParseConfigFromFile(filename string) (*Config, error) {
-	file, err := os.Open(filename)
+	return ParseConfigFromFileAs(filename, FormatJSON)
+}
+
+// ParseConfigFromFileAs is like ParseConfigFromFile, but parses files with extensions of no
+// known format in the given format.
+func ParseConfigFromFileAs(filename string, format Format) (*Config, error) {
+	l := newLoader(format)
+	err := l.loadPath(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	return parseConfig(file)
+	return l.cfg, nil
 }
 
 // ParseConfigFromReadSeeker returns a pointer to a new Config object.
 // The config is read from a in memory buffer.
+// Any files referenced by "Include" are merged into the config - relative to
+// the current directory.
 func ParseConfigFromReadSeeker(data io.ReadSeeker) (*Config, error) {
+	return ParseConfigFromReadSeekerAs(data, FormatJSON)
+}
+
+// ParseConfigFromReadSeekerAs is like ParseConfigFromReadSeeker, but parses the buffer in the given format.
+func ParseConfigFromReadSeekerAs(data io.ReadSeeker, format Format) (*Config, error) {
 	data.Seek(0, io.SeekStart)
-	return parseConfig(data)
+	cfg, err := parseConfig(data, format)
+	if err != nil {
+		return nil, err
+	}
+	l := newLoader(format)
+	err = l.add(cfg, "", ".")
+	if err != nil {
+		return nil, err
+	}
+	return l.cfg, nil
 }
 
 // ParseConfig Read config from the supplied io.Reader and parse it
-func parseConfig(stream io.Reader) (*Config, error) {
+// after substituting any references to values outside the config.
+// Formats other than JSON are converted to JSON first.
+func parseConfig(stream io.Reader, format Format) (*Config, error) {
+	data, err := ioutil.ReadAll(stream)
+	if err != nil {
+		return nil, err
+	}
+
+	var secrets [][]string
+	switch format {
+	case FormatJSON, "":
+		data, secrets, err = interpolate(data)
+	default:
+		data, secrets, err = toJSON(data, format)
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	var config *Config
-	err := jconf.ParseInto(stream, &config)
+	err = jconf.ParseInto(bytes.NewReader(data), &config)
+	if config != nil {
+		config.secrets = secrets
+	}
 	return config, err
 }
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// PathError is a config error located by the path of JSON keys leading to
+// the offending value - like "Handlers.api.Config.Modules.hdr.Config.RequestHeader".
+type PathError struct {
+	Path []string
+	Err  error
+}
+
+func (e *PathError) Error() string {
+	return strings.Join(e.Path, ".") + ": " + e.Err.Error()
+}
+
+// Unwrap returns the error located by the path.
+func (e *PathError) Unwrap() error {
+	return e.Err
+}
+
+// AtPath locates err at the given path relative to where the caller parsed its config.
+// If err is already located by a PathError, path is prepended to its path.
+// If err is a JSON type error, the offending JSON field is appended to the path.
+// A nil err returns nil.
+func AtPath(err error, path ...string) error {
+	if err == nil {
+		return nil
+	}
+
+	if list, ok := err.(Errors); ok {
+		located := make(Errors, len(list))
+		for i, e := range list {
+			located[i] = AtPath(e, path...)
+		}
+		return located
+	}
+
+	p := make([]string, len(path), len(path)+4)
+	copy(p, path)
+
+	var pe *PathError
+	if errors.As(err, &pe) {
+		return &PathError{Path: append(p, pe.Path...), Err: pe.Err}
+	}
+
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) && te.Field != "" {
+		p = append(p, strings.Split(te.Field, ".")...)
+	}
+	return &PathError{Path: p, Err: err}
+}
+
+// Errors is a list of config errors to be reported together, instead of
+// stopping at the first one.
+type Errors []error
+
+func (e Errors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Add appends err to the list, flattening any nested Errors. nil is ignored.
+func (e *Errors) Add(err error) {
+	if err == nil {
+		return
+	}
+	if list, ok := err.(Errors); ok {
+		for _, le := range list {
+			e.Add(le)
+		}
+		return
+	}
+	*e = append(*e, err)
+}
+
+// Err returns the list as an error - or nil if it's empty.
+func (e Errors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
@@ -0,0 +1,267 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a config file format.
+// Whatever the format, the config is converted to JSON before being parsed, so handler and
+// module sub configs (jconf.SubConfig) are parsed the same way.
+type Format string
+
+// Supported config formats.
+const (
+	FormatJSON Format = "json"
+	FormatYAML Format = "yaml"
+	FormatTOML Format = "toml"
+)
+
+// formatExtensions maps config file name extensions to their format.
+var formatExtensions = map[string]Format{
+	".json": FormatJSON,
+	".yaml": FormatYAML,
+	".yml":  FormatYAML,
+	".toml": FormatTOML,
+}
+
+// FormatOf returns the format of a config file given by its extension - or "" if unknown.
+func FormatOf(filename string) Format {
+	return formatExtensions[filepath.Ext(filename)]
+}
+
+// ParseFormat returns the Format named by s (like "yaml" or "yml").
+func ParseFormat(s string) (Format, error) {
+	if f, ok := formatExtensions["."+strings.ToLower(s)]; ok {
+		return f, nil
+	}
+	return "", fmt.Errorf("Unknown config format: %s", s)
+}
+
+// toJSON converts YAML or TOML config data to JSON, substituting references
+// to values outside the config in all string values.
+func toJSON(data []byte, format Format) (out []byte, secrets [][]string, err error) {
+
+	var tree interface{}
+	switch format {
+	case FormatYAML:
+		err = yaml.Unmarshal(data, &tree)
+	case FormatTOML:
+		var table map[string]interface{}
+		_, err = toml.Decode(string(data), &table)
+		tree = table
+	default:
+		err = fmt.Errorf("Unknown config format: %s", format)
+	}
+	if err != nil {
+		return
+	}
+	if tree == nil {
+		// An empty document is an empty config.
+		tree = map[string]interface{}{}
+	}
+
+	tree, secrets, err = interpolateTree(tree, nil)
+	if err != nil {
+		return
+	}
+
+	out, err = json.Marshal(tree)
+	return
+}
+
+// interpolateTree substitutes references in all string values of a decoded config -
+// returning the paths of the values secrets were substituted into.
+// YAML maps with non-string keys are converted to have string keys.
+func interpolateTree(v interface{}, path []string) (out interface{}, secrets [][]string, err error) {
+	switch t := v.(type) {
+	case string:
+		var secret bool
+		out, secret, err = expandReferences(t, path)
+		if secret {
+			secrets = append(secrets, append([]string(nil), path...))
+		}
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			var s [][]string
+			m[k], s, err = interpolateTree(e, append(path, k))
+			if err != nil {
+				return
+			}
+			secrets = append(secrets, s...)
+		}
+		out = m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			key := fmt.Sprint(k)
+			var s [][]string
+			m[key], s, err = interpolateTree(e, append(path, key))
+			if err != nil {
+				return
+			}
+			secrets = append(secrets, s...)
+		}
+		out = m
+	case []interface{}:
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			var s [][]string
+			l[i], s, err = interpolateTree(e, append(path, strconv.Itoa(i)))
+			if err != nil {
+				return
+			}
+			secrets = append(secrets, s...)
+		}
+		out = l
+	case []map[string]interface{}:
+		// TOML arrays of tables
+		l := make([]interface{}, len(t))
+		for i, e := range t {
+			var s [][]string
+			l[i], s, err = interpolateTree(e, append(path, strconv.Itoa(i)))
+			if err != nil {
+				return
+			}
+			secrets = append(secrets, s...)
+		}
+		out = l
+	default:
+		out = v
+	}
+	return
+}
+
+// expandReferences substitutes references in a decoded string value - telling whether a secret
+// was substituted.
+func expandReferences(s string, path []string) (out string, secret bool, err error) {
+	if !strings.Contains(s, "${") {
+		return s, false, nil
+	}
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch {
+		case strings.HasPrefix(s[i:], "$${"):
+			buf.WriteString("${")
+			i += 2
+		case strings.HasPrefix(s[i:], "${"):
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				err = AtPath(fmt.Errorf("Unterminated reference"), path...)
+				return
+			}
+			value, isSecret, e := resolveReference(s[i+2 : i+end])
+			if e != nil {
+				err = AtPath(e, path...)
+				return
+			}
+			if isSecret && value != "" {
+				secret = true
+			}
+			buf.WriteString(value)
+			i += end
+		default:
+			buf.WriteByte(s[i])
+		}
+	}
+	out = buf.String()
+	return
+}
+
+// DumpFormat serializes the config as configured in the given format.
+// Secret values substituted from files and credentials are redacted.
+func (cfg *Config) DumpFormat(dest io.Writer, format Format) error {
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	b, err = redact(b, cfg.secrets)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	switch format {
+	case FormatJSON, "":
+		err = json.Indent(&out, b, "", "    ")
+		out.WriteByte('\n')
+	case FormatYAML:
+		// YAML is a superset of JSON. Decoding into a node keeps the order of the fields.
+		var node yaml.Node
+		err = yaml.Unmarshal(b, &node)
+		if err != nil {
+			return err
+		}
+		blockStyle(&node)
+		enc := yaml.NewEncoder(&out)
+		enc.SetIndent(2)
+		err = enc.Encode(&node)
+		if err == nil {
+			err = enc.Close()
+		}
+	case FormatTOML:
+		var tree interface{}
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&tree)
+		if err != nil {
+			return err
+		}
+		err = toml.NewEncoder(&out).Encode(tomlValue(tree))
+	default:
+		err = fmt.Errorf("Unknown config format: %s", format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.WriteTo(dest)
+	return err
+}
+
+// blockStyle clears the JSON flow style of YAML nodes decoded from JSON.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+// tomlValue prepares a value decoded from JSON for TOML, which has no null values
+// and distinguishes integers from floats.
+func tomlValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			if e != nil {
+				m[k] = tomlValue(e)
+			}
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, 0, len(t))
+		for _, e := range t {
+			if e != nil {
+				l = append(l, tomlValue(e))
+			}
+		}
+		return l
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		f, _ := t.Float64()
+		return f
+	}
+	return v
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormats(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("OZONE_TEST_UPSTREAM", "http://backend:8080/")
+	writeFiles(t, dir, map[string]string{
+		"ozone.yaml": `
+Include: [ conf.d ]
+HTTP:
+  main:
+    Handler: api
+    Listeners:
+      http: { Port: 8080 }
+`,
+		"conf.d/api.toml": `
+[Handlers.api]
+Type = "ReverseProxy"
+[Handlers.api.Config]
+Upstream = "${ENV:OZONE_TEST_UPSTREAM}"
+Retries = 2
+`,
+	})
+
+	cfg, err := ParseConfigFromFile(filepath.Join(dir, "ozone.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTPServers["main"].Listeners["http"].Port != 8080 {
+		t.Errorf("YAML listener not parsed: %+v", cfg.HTTPServers["main"])
+	}
+
+	var sub struct {
+		Upstream string
+		Retries  int
+	}
+	err = cfg.Handlers["api"].Config.ParseInto(&sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub.Upstream != "http://backend:8080/" || sub.Retries != 2 {
+		t.Errorf("TOML sub config not parsed: %+v", sub)
+	}
+
+	// Dumps in all formats must parse to the same config.
+	for _, format := range []Format{FormatJSON, FormatYAML, FormatTOML} {
+		var out bytes.Buffer
+		err = cfg.DumpFormat(&out, format)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		dumped, err := ParseConfigFromReadSeekerAs(strings.NewReader(out.String()), format)
+		if err != nil {
+			t.Fatalf("%s: %s\n%s", format, err, out.String())
+		}
+		if dumped.Handlers["api"].Type != "ReverseProxy" || dumped.HTTPServers["main"].Listeners["http"].Port != 8080 {
+			t.Errorf("%s: dump doesn't parse to the config:\n%s", format, out.String())
+		}
+	}
+}
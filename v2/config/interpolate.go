@@ -0,0 +1,313 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Config values can reference values from outside the config file.
+// Inside any JSON string value:
+//
+//   ${ENV:NAME}         is replaced by the environment variable NAME
+//   ${FILE:/path}       is replaced by the content of the file (without trailing newline)
+//   ${CREDENTIAL:name}  is replaced by the systemd credential "name" from $CREDENTIALS_DIRECTORY
+//   $${                 is a literal "${"
+//
+// Values read from files and credentials are considered secrets. The JSON string
+// values they are substituted into are redacted when the config is dumped.
+
+// redacted replaces secret values in config dumps.
+const redacted = "<redacted>"
+
+// interpolate substitutes references in the JSON string values of data.
+// Comments are left alone. It returns the resulting data and the paths of the
+// values secrets were substituted into.
+func interpolate(data []byte) (out []byte, secrets [][]string, err error) {
+
+	if !bytes.Contains(data, []byte("${")) {
+		return data, nil, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data))
+
+	var inString, inComment, escaped bool
+	var path jsonPath
+	var start int        // of the current string in buf
+	var secretValue bool // the current string has a secret substituted
+	line := 1
+
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		if c == '\n' {
+			line++
+		}
+
+		switch {
+		case inComment:
+			if c == '\n' {
+				inComment = false
+			}
+		case !inString:
+			if c == '"' {
+				inString = true
+				start = buf.Len()
+			} else if c == '/' && i+1 < len(data) && data[i+1] == '/' {
+				inComment = true
+			} else {
+				path.structural(c)
+			}
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			inString = false
+			buf.WriteByte(c)
+			if path.string(buf.Bytes()[start:]) && secretValue {
+				secrets = append(secrets, path.current())
+			}
+			secretValue = false
+			continue
+		case c == '$' && bytes.HasPrefix(data[i+1:], []byte("${")):
+			// escaped reference
+			buf.WriteString("${")
+			i += 2
+			continue
+		case c == '$' && bytes.HasPrefix(data[i+1:], []byte("{")):
+			end := bytes.IndexAny(data[i:], "}\"\n")
+			if end == -1 || data[i+end] != '}' {
+				err = fmt.Errorf("Unterminated reference (line %d)", line)
+				return
+			}
+			ref := string(data[i+2 : i+end])
+			value, secret, e := resolveReference(ref)
+			if e != nil {
+				err = fmt.Errorf("%s (line %d)", e.Error(), line)
+				return
+			}
+			if secret && value != "" {
+				secretValue = true
+			}
+			buf.Write(jsonStringContent(value))
+			i += end
+			continue
+		}
+		buf.WriteByte(c)
+	}
+
+	out = buf.Bytes()
+	return
+}
+
+// resolveReference looks up the value of a "SOURCE:name" reference.
+func resolveReference(ref string) (value string, secret bool, err error) {
+	parts := strings.SplitN(ref, ":", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		err = fmt.Errorf("Invalid reference: ${%s}", ref)
+		return
+	}
+	source, name := parts[0], parts[1]
+
+	switch source {
+	case "ENV":
+		var ok bool
+		value, ok = os.LookupEnv(name)
+		if !ok {
+			err = fmt.Errorf("Environment variable not set: %s", name)
+		}
+	case "FILE":
+		secret = true
+		value, err = readSecretFile(name)
+	case "CREDENTIAL":
+		secret = true
+		dir := os.Getenv("CREDENTIALS_DIRECTORY")
+		if dir == "" {
+			err = fmt.Errorf("No systemd credentials ($CREDENTIALS_DIRECTORY not set) for: %s", name)
+			return
+		}
+		if strings.ContainsRune(name, '/') {
+			err = fmt.Errorf("Invalid credential name: %s", name)
+			return
+		}
+		value, err = readSecretFile(filepath.Join(dir, name))
+	default:
+		err = fmt.Errorf("Unknown reference type: ${%s}", ref)
+	}
+	return
+}
+
+func readSecretFile(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// jsonStringContent returns s encoded as the content of a JSON string (without the quotes).
+func jsonStringContent(s string) []byte {
+	b, _ := json.Marshal(s)
+	return b[1 : len(b)-1]
+}
+
+// jsonPath follows the path to the current value while scanning JSON.
+type jsonPath struct {
+	frames []pathFrame
+}
+
+type pathFrame struct {
+	array bool
+	index int    // of the current array element
+	key   string // of the current object member
+	inKey bool   // an object key is expected
+}
+
+// structural updates the path for a character outside strings.
+func (p *jsonPath) structural(c byte) {
+	n := len(p.frames)
+	switch c {
+	case '{':
+		p.frames = append(p.frames, pathFrame{inKey: true})
+	case '[':
+		p.frames = append(p.frames, pathFrame{array: true})
+	case '}', ']':
+		if n != 0 {
+			p.frames = p.frames[:n-1]
+		}
+	case ',':
+		if n != 0 {
+			if p.frames[n-1].array {
+				p.frames[n-1].index++
+			} else {
+				p.frames[n-1].inKey = true
+			}
+		}
+	case ':':
+		if n != 0 {
+			p.frames[n-1].inKey = false
+		}
+	}
+}
+
+// string records a JSON string literal. It returns true if it's a value - not an object key.
+func (p *jsonPath) string(literal []byte) bool {
+	n := len(p.frames)
+	if n == 0 || p.frames[n-1].array || !p.frames[n-1].inKey {
+		return true
+	}
+	var key string
+	json.Unmarshal(literal, &key)
+	p.frames[n-1].key = key
+	return false
+}
+
+// current returns the path of the current value.
+func (p *jsonPath) current() []string {
+	path := make([]string, len(p.frames))
+	for i, f := range p.frames {
+		if f.array {
+			path[i] = strconv.Itoa(f.index)
+		} else {
+			path[i] = f.key
+		}
+	}
+	return path
+}
+
+// redact replaces the values at the paths of secrets in JSON data.
+// Paths are matched ignoring case, like JSON is parsed into structs.
+func redact(data []byte, secrets [][]string) ([]byte, error) {
+	if len(secrets) == 0 {
+		return data, nil
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+	err := redactValue(dec, &out, nil, secrets)
+	return out.Bytes(), err
+}
+
+// redactValue copies the next value from dec to out - redacting secrets.
+func redactValue(dec *json.Decoder, out *bytes.Buffer, path []string, secrets [][]string) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	delim, isDelim := tok.(json.Delim)
+	if isSecret(path, secrets) {
+		if isDelim {
+			// Skip the container.
+			for depth := 1; depth != 0; {
+				if tok, err = dec.Token(); err != nil {
+					return err
+				}
+				switch tok {
+				case json.Delim('{'), json.Delim('['):
+					depth++
+				case json.Delim('}'), json.Delim(']'):
+					depth--
+				}
+			}
+		}
+		out.WriteString(strconv.Quote(redacted))
+		return nil
+	}
+	if !isDelim {
+		b, err := json.Marshal(tok)
+		if err != nil {
+			return err
+		}
+		out.Write(b)
+		return nil
+	}
+
+	out.WriteRune(rune(delim))
+	for i := 0; dec.More(); i++ {
+		if i != 0 {
+			out.WriteByte(',')
+		}
+		elem := strconv.Itoa(i)
+		if delim == '{' {
+			if tok, err = dec.Token(); err != nil {
+				return err
+			}
+			elem, _ = tok.(string)
+			b, _ := json.Marshal(elem)
+			out.Write(b)
+			out.WriteByte(':')
+		}
+		if err = redactValue(dec, out, append(path[:len(path):len(path)], elem), secrets); err != nil {
+			return err
+		}
+	}
+	if tok, err = dec.Token(); err != nil {
+		return err
+	}
+	out.WriteRune(rune(tok.(json.Delim)))
+	return nil
+}
+
+func isSecret(path []string, secrets [][]string) bool {
+	if len(path) == 0 {
+		return false
+	}
+NEXT:
+	for _, secret := range secrets {
+		if len(secret) != len(path) {
+			continue
+		}
+		for i := range path {
+			if !strings.EqualFold(path[i], secret[i]) {
+				continue NEXT
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"password":        "s3cr\"et\n",
+		"creds/statsdkey": "key",
+	})
+	t.Setenv("OZONE_TEST_UPSTREAM", "http://backend:8080/")
+	t.Setenv("CREDENTIALS_DIRECTORY", filepath.Join(dir, "creds"))
+
+	js := `{
+    // ${ENV:NOT_IN_COMMENTS}
+    "Handlers" : {
+        "api" : {
+            "Type" : "ReverseProxy",
+            "Config" : {
+                "Upstream" : "${ENV:OZONE_TEST_UPSTREAM}",
+                "Auth" : "user:${FILE:` + filepath.Join(dir, "password") + `}",
+                "Key" : "${CREDENTIAL:statsdkey}",
+                "KeyName" : "key",
+                "Literal" : "$${ENV:HOME}"
+            }
+        }
+    }
+}`
+	cfg, err := ParseConfigFromReadSeeker(strings.NewReader(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sub map[string]string
+	err = cfg.Handlers["api"].Config.ParseInto(&sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{
+		"Upstream": "http://backend:8080/",
+		"Auth":     "user:s3cr\"et",
+		"Key":      "key",
+		"KeyName":  "key",
+		"Literal":  "${ENV:HOME}",
+	}
+	for k, v := range expected {
+		if sub[k] != v {
+			t.Errorf("%s: expected %q, got %q", k, v, sub[k])
+		}
+	}
+
+	var out bytes.Buffer
+	cfg.Dump(&out)
+	dump := out.String()
+	if strings.Contains(dump, "s3cr") || !strings.Contains(dump, `"Key": "<redacted>"`) {
+		t.Errorf("Secret not redacted: %s", dump)
+	}
+	if !strings.Contains(dump, `"KeyName": "key"`) {
+		t.Errorf("Value not substituted redacted: %s", dump)
+	}
+	if !strings.Contains(dump, "http://backend:8080/") {
+		t.Errorf("Environment value not dumped: %s", dump)
+	}
+
+	// Only the values secrets are substituted into are redacted - also in other formats.
+	cfg, err = ParseConfigFromReadSeekerAs(strings.NewReader(`
+TLSPluginDir: ${CREDENTIAL:statsdkey}
+Handlers: { key: { Type: NotFound } }
+`), FormatYAML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	cfg.Dump(&out)
+	dump = out.String()
+	if !strings.Contains(dump, `"TLSPluginDir": "<redacted>"`) || !strings.Contains(dump, `"key": {`) {
+		t.Errorf("Bad redaction: %s", dump)
+	}
+
+	_, err = ParseConfigFromReadSeeker(strings.NewReader(`{ "TLSPluginDir" : "${ENV:OZONE_TEST_UNSET}" }`))
+	if err == nil {
+		t.Error("Expected error for unset environment variable")
+	}
+}
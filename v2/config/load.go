@@ -0,0 +1,213 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// loader merges a config from several files, keeping track of which file
+// defined which part of the config to report duplicates.
+type loader struct {
+	format  Format // of files with no known format extension
+	cfg     *Config
+	origins map[string]string // config path -> file defining it
+	seen    map[string]bool   // absolute paths of loaded files
+}
+
+func newLoader(format Format) *loader {
+	return &loader{
+		format:  format,
+		cfg:     &Config{},
+		origins: make(map[string]string),
+		seen:    make(map[string]bool),
+	}
+}
+
+// loadPath loads a config file - or all config files in a directory.
+func (l *loader) loadPath(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return l.loadDir(path)
+	}
+	return l.loadFile(path)
+}
+
+// loadDir loads all config files in a directory in lexical order. Sub directories are ignored.
+func (l *loader) loadDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	l.cfg.dirs = append(l.cfg.dirs, dir)
+	var files []string
+	for _, entry := range entries {
+		if entry.IsDir() || !IsConfigFile(entry.Name()) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(files)
+
+	for _, file := range files {
+		err = l.loadFile(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadFile loads a config file. A file is only loaded once - even if included by several files.
+func (l *loader) loadFile(filename string) error {
+	abspath, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	if l.seen[abspath] {
+		return nil
+	}
+	l.seen[abspath] = true
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	format := FormatOf(filename)
+	if format == "" {
+		format = l.format
+	}
+	cfg, err := parseConfig(file, format)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	return l.add(cfg, filename, filepath.Dir(filename))
+}
+
+// add merges cfg read from file into the loaded config and then loads
+// any files it includes - relative to dir.
+func (l *loader) add(cfg *Config, file string, dir string) error {
+	if file != "" {
+		l.cfg.files = append(l.cfg.files, file)
+	}
+	if cfg == nil {
+		return nil
+	}
+	l.cfg.secrets = append(l.cfg.secrets, cfg.secrets...)
+
+	err := l.merge(cfg, file)
+	if err != nil {
+		return err
+	}
+
+	for _, include := range cfg.Include {
+		pattern := include
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return AtPath(fmt.Errorf("%s: %w", describeFile(file), err), "Include")
+		}
+		if matches == nil && !hasGlobMeta(include) {
+			// A pattern may match nothing, but a plain file name must exist.
+			if _, err = os.Stat(pattern); err == nil {
+				err = fmt.Errorf("Include %s matches no file", include)
+			}
+			return AtPath(fmt.Errorf("%s: %w", describeFile(file), err), "Include")
+		}
+		for _, match := range matches {
+			err = l.loadPath(match)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// merge adds the servers, handlers and TLS plugins of cfg to the loaded config.
+// Names can only be defined once across all files. So can the global sections.
+func (l *loader) merge(cfg *Config, file string) error {
+	var errs Errors
+
+	define := func(path ...string) bool {
+		key := fmt.Sprint(path)
+		if orig, dup := l.origins[key]; dup {
+			errs.Add(AtPath(fmt.Errorf("Defined in both %s and %s", describeFile(orig), describeFile(file)), path...))
+			return false
+		}
+		l.origins[key] = file
+		return true
+	}
+
+	for name, srv := range cfg.HTTPServers {
+		if define("HTTP", name) {
+			if l.cfg.HTTPServers == nil {
+				l.cfg.HTTPServers = make(HTTPServersConfig)
+			}
+			l.cfg.HTTPServers[name] = srv
+		}
+	}
+	for name, handler := range cfg.Handlers {
+		if define("Handlers", name) {
+			if l.cfg.Handlers == nil {
+				l.cfg.Handlers = make(HandlersConfig)
+			}
+			l.cfg.Handlers[name] = handler
+		}
+	}
+	for name, plugin := range cfg.TLSPlugins {
+		if define("TLSPlugins", name) {
+			if l.cfg.TLSPlugins == nil {
+				l.cfg.TLSPlugins = make(TLSPluginsConfig)
+			}
+			l.cfg.TLSPlugins[name] = plugin
+		}
+	}
+
+	if cfg.Log != nil && define("Log") {
+		l.cfg.Log = cfg.Log
+	}
+	if cfg.Metrics != nil && define("Metrics") {
+		l.cfg.Metrics = cfg.Metrics
+	}
+	if cfg.SNI != nil && define("SNI") {
+		l.cfg.SNI = cfg.SNI
+	}
+	if cfg.TLSPluginDir != "" && define("TLSPluginDir") {
+		l.cfg.TLSPluginDir = cfg.TLSPluginDir
+	}
+
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Error() < errs[j].Error() })
+	return errs.Err()
+}
+
+func describeFile(file string) string {
+	if file == "" {
+		return "<main config>"
+	}
+	return file
+}
+
+// IsConfigFile tells whether a file name has the extension of a config file
+// loaded when its directory is loaded - any supported format.
+func IsConfigFile(name string) bool {
+	return FormatOf(name) != ""
+}
+
+func hasGlobMeta(path string) bool {
+	for _, c := range path {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
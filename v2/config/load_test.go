@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"ozone.json": `{
+    // Handlers live with the teams
+    "Include" : [ "conf.d", "extra/*.json" ],
+    "HTTP" : { "main" : { "Handler" : "api" } }
+}`,
+		"conf.d/10-api.json":   `{ "Handlers" : { "api" : { "Type" : "ReverseProxy" } } }`,
+		"conf.d/20-other.json": `{ "HTTP" : { "other" : { "Handler" : "NotFound" } } }`,
+		"conf.d/README":        `not a config file`,
+		"extra/tls.json":       `{ "TLSPlugins" : { "sni" : { "Type" : "autocert" } } }`,
+	})
+
+	cfg, err := ParseConfigFromFile(filepath.Join(dir, "ozone.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.HTTPServers) != 2 || len(cfg.Handlers) != 1 || len(cfg.TLSPlugins) != 1 {
+		t.Errorf("Config not merged: %d servers, %d handlers, %d TLS plugins", len(cfg.HTTPServers), len(cfg.Handlers), len(cfg.TLSPlugins))
+	}
+	if cfg.Include != nil {
+		t.Error("Include left in merged config")
+	}
+	if len(cfg.Files()) != 4 {
+		t.Errorf("Expected 4 files loaded, got %v", cfg.Files())
+	}
+
+	// Directory mode
+	cfg, err = ParseConfigFromFile(filepath.Join(dir, "conf.d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.HTTPServers) != 1 || len(cfg.Handlers) != 1 {
+		t.Errorf("Directory not merged: %d servers, %d handlers", len(cfg.HTTPServers), len(cfg.Handlers))
+	}
+}
+
+func TestIncludeTwice(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"ozone.json":  `{ "Include" : [ "a.json", "b.json" ] }`,
+		"a.json":      `{ "Include" : [ "common.json" ], "HTTP" : { "a" : { "Handler" : "api" } } }`,
+		"b.json":      `{ "Include" : [ "common.json" ], "HTTP" : { "b" : { "Handler" : "api" } } }`,
+		"common.json": `{ "Handlers" : { "api" : { "Type" : "ReverseProxy" } } }`,
+	})
+
+	cfg, err := ParseConfigFromFile(filepath.Join(dir, "ozone.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.HTTPServers) != 2 || len(cfg.Handlers) != 1 {
+		t.Errorf("Config not merged: %d servers, %d handlers", len(cfg.HTTPServers), len(cfg.Handlers))
+	}
+	if len(cfg.Files()) != 4 {
+		t.Errorf("Expected 4 files loaded, got %v", cfg.Files())
+	}
+}
+
+func TestIncludeDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"ozone.json": `{
+    "Include" : [ "api.json", "missing/*.json" ],
+    "Handlers" : { "api" : { "Type" : "Redirect" } }
+}`,
+		"api.json": `{ "Handlers" : { "api" : { "Type" : "ReverseProxy" } } }`,
+	})
+
+	_, err := ParseConfigFromFile(filepath.Join(dir, "ozone.json"))
+	var errs Errors
+	var pe *PathError
+	if !errors.As(err, &errs) || len(errs) != 1 || !errors.As(errs[0], &pe) {
+		t.Fatalf("Expected a PathError, got: %v", err)
+	}
+	if path := strings.Join(pe.Path, "."); path != "Handlers.api" {
+		t.Errorf("Duplicate reported at %s", path)
+	}
+
+	writeFiles(t, dir, map[string]string{
+		"ozone.json": `{ "Include" : [ "nosuchfile.json" ] }`,
+	})
+	_, err = ParseConfigFromFile(filepath.Join(dir, "ozone.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected missing include file error, got: %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/One-com/gone/jconf"
+)
+
+// Schema is a JSON Schema - or a part of one - as its JSON object.
+type Schema map[string]interface{}
+
+// SchemaDraft is the JSON Schema version generated.
+const SchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+
+var (
+	durationType          = reflect.TypeOf(jconf.Duration{})
+	optionalSubConfigType = reflect.TypeOf(jconf.OptionalSubConfig{})
+	mandatorySubConfType  = reflect.TypeOf(jconf.MandatorySubConfig{})
+	rawMessageType        = reflect.TypeOf(json.RawMessage{})
+	timeDurationType      = reflect.TypeOf(time.Duration(0))
+	schemaType            = reflect.TypeOf(Schema{})
+)
+
+// SchemaOf generates a JSON Schema for the JSON of values of the type of v - typically
+// a pointer to the config struct a sub config is parsed into.
+// Fields are named like encoding/json does. Sub configs (jconf.SubConfig) can be anything.
+// If v is a Schema, it's returned as is.
+func SchemaOf(v interface{}) Schema {
+	if s, ok := v.(Schema); ok {
+		return s
+	}
+	if v == nil {
+		return Schema{}
+	}
+	return schemaOfType(reflect.TypeOf(v), make(map[reflect.Type]bool))
+}
+
+// schemaOfType generates the schema for t. inProgress holds the struct types
+// being generated to stop on recursive types.
+func schemaOfType(t reflect.Type, inProgress map[reflect.Type]bool) Schema {
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case durationType:
+		return Schema{
+			"type":        []string{"string", "integer"},
+			"description": `Duration like "1m30s" - or nanoseconds`,
+		}
+	case optionalSubConfigType, mandatorySubConfType, rawMessageType, schemaType:
+		return Schema{}
+	case timeDurationType:
+		return Schema{"type": "integer", "description": "Nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return Schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Schema{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return Schema{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return Schema{"type": "number"}
+	case reflect.String:
+		return Schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return Schema{"type": "string", "contentEncoding": "base64"}
+		}
+		return Schema{"type": "array", "items": schemaOfType(t.Elem(), inProgress)}
+	case reflect.Map:
+		return Schema{"type": "object", "additionalProperties": schemaOfType(t.Elem(), inProgress)}
+	case reflect.Struct:
+		if inProgress[t] {
+			return Schema{}
+		}
+		inProgress[t] = true
+		defer delete(inProgress, t)
+
+		properties := Schema{}
+		addStructFields(t, properties, inProgress)
+		return Schema{"type": "object", "properties": properties}
+	}
+	// interfaces and whatever can't be known.
+	return Schema{}
+}
+
+// addStructFields adds the schemas of the JSON fields of struct t to properties.
+// Fields of embedded structs are promoted like encoding/json does - after the fields
+// of the outer struct, which win.
+func addStructFields(t reflect.Type, properties Schema, inProgress map[reflect.Type]bool) {
+	var embedded []reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		if f.Anonymous && name == "" {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				embedded = append(embedded, ft)
+				continue
+			}
+		}
+		if f.PkgPath != "" { // unexported
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = schemaOfType(f.Type, inProgress)
+	}
+	for _, et := range embedded {
+		promoted := Schema{}
+		addStructFields(et, promoted, inProgress)
+		for name, ps := range promoted {
+			if _, exists := properties[name]; !exists {
+				properties[name] = ps
+			}
+		}
+	}
+}
+
+// Property returns the schema of a property of an object schema - or nil.
+// Use it to amend generated schemas.
+func (s Schema) Property(names ...string) Schema {
+	for _, name := range names {
+		props, ok := s["properties"].(Schema)
+		if !ok {
+			return nil
+		}
+		if s, ok = props[name].(Schema); !ok {
+			return nil
+		}
+	}
+	return s
+}
+
+// Elements returns the schema of the values of a map schema - or nil.
+func (s Schema) Elements() Schema {
+	e, _ := s["additionalProperties"].(Schema)
+	return e
+}
+
+// SetTypedConfig makes the schema of the config property of an object schema depend on the
+// value of its "Type" property - using the schemas of the types given.
+// Types not given can have any config.
+func (s Schema) SetTypedConfig(property string, types map[string]Schema) {
+	if s == nil || len(types) == 0 {
+		return
+	}
+	var conditions []interface{}
+	for _, name := range sortedKeys(types) {
+		conditions = append(conditions, Schema{
+			"if": Schema{
+				"properties": Schema{"Type": Schema{"const": name}},
+				"required":   []string{"Type"},
+			},
+			"then": Schema{
+				"properties": Schema{property: types[name]},
+			},
+		})
+	}
+	s["allOf"] = conditions
+}
+
+func sortedKeys(m map[string]Schema) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
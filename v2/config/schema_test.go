@@ -0,0 +1,54 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/One-com/gone/jconf"
+)
+
+type schemaTestInner struct {
+	Inner string
+	Outer int
+}
+
+type schemaTestConfig struct {
+	schemaTestInner
+	Outer    bool
+	Renamed  string `json:"name,omitempty"`
+	Skipped  string `json:"-"`
+	private  string
+	Timeout  jconf.Duration
+	Sub      *jconf.OptionalSubConfig
+	Backends map[string][]*schemaTestConfig
+}
+
+func TestSchemaOf(t *testing.T) {
+	s := SchemaOf(&schemaTestConfig{})
+
+	props := s["properties"].(Schema)
+	for _, name := range []string{"Skipped", "private", "Renamed", "schemaTestInner"} {
+		if _, ok := props[name]; ok {
+			t.Errorf("Unexpected property %s", name)
+		}
+	}
+	checks := map[string]interface{}{
+		"Inner": "string",
+		"Outer": "boolean",
+		"name":  "string",
+	}
+	for name, typ := range checks {
+		if got := s.Property(name)["type"]; got != typ {
+			t.Errorf("%s: got type %v, expected %v", name, got, typ)
+		}
+	}
+	if _, ok := s.Property("Timeout")["type"].([]string); !ok {
+		t.Errorf("Timeout is not string or integer: %v", s.Property("Timeout"))
+	}
+	if len(s.Property("Sub")) != 0 {
+		t.Errorf("Sub config is restricted: %v", s.Property("Sub"))
+	}
+	items, _ := s.Property("Backends").Elements()["items"].(Schema)
+	if items == nil || len(items) != 0 {
+		t.Errorf("Recursive type not cut off: %v", s.Property("Backends"))
+	}
+}
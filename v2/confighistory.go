@@ -0,0 +1,257 @@
+package ozone
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// configEntry is a successfully loaded config.
+type configEntry struct {
+	seq    int       // number of the config loaded since start
+	loaded time.Time // when the config was loaded
+	hash   string    // of the full config - including secrets
+	dump   []byte    // the config dumped as JSON - secrets redacted
+}
+
+// configHistory keeps the last successfully loaded configs for the "config" control command.
+// The configs are dumped when loaded, since the parsed config of handlers can change
+// when later reloads build new handlers.
+type configHistory struct {
+	mu      sync.Mutex
+	size    int
+	seq     int
+	entries []*configEntry // oldest first. The last is the running config.
+}
+
+var loadedConfigs = &configHistory{}
+
+// add records a loaded config.
+func (h *configHistory) add(cfg *config.Config) {
+	var dump bytes.Buffer
+	err := cfg.DumpFormat(&dump, config.FormatJSON)
+	if err != nil {
+		return
+	}
+	full, err := json.Marshal(cfg)
+	if err != nil {
+		return
+	}
+	sum := sha256.Sum256(full)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	h.entries = append(h.entries, &configEntry{
+		seq:    h.seq,
+		loaded: time.Now(),
+		hash:   hex.EncodeToString(sum[:6]),
+		dump:   dump.Bytes(),
+	})
+	size := h.size
+	if size <= 0 {
+		size = 1 // always keep the running config
+	}
+	if len(h.entries) > size {
+		h.entries = h.entries[len(h.entries)-size:]
+	}
+}
+
+// setSize sets how many configs to keep.
+func (h *configHistory) setSize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.size = size
+}
+
+// get returns the config with the given sequence number - or the running config if seq is 0.
+func (h *configHistory) get(seq int) *configEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.entries) == 0 {
+		return nil
+	}
+	if seq == 0 {
+		return h.entries[len(h.entries)-1]
+	}
+	for _, e := range h.entries {
+		if e.seq == seq {
+			return e
+		}
+	}
+	return nil
+}
+
+// list returns the configs kept, newest first.
+func (h *configHistory) list() (entries []*configEntry) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i := len(h.entries) - 1; i >= 0; i-- {
+		entries = append(entries, h.entries[i])
+	}
+	return
+}
+
+// ---------------------------------------------------------------
+// A control socket command to inspect the running config
+
+var configControl = &configCommand{history: loadedConfigs}
+
+type configCommand struct {
+	history *configHistory
+}
+
+func (c *configCommand) ShortUsage() (syntax, comment string) {
+	syntax = "[show [<n>]|history|diff <a> [<b>]]"
+	comment = "inspect the running config"
+	return
+}
+
+func (c *configCommand) Usage(cmd string, w io.Writer) {
+	fmt.Fprintln(w, cmd, "show [<n>]      Dump the running config - or config <n> from the history")
+	fmt.Fprintln(w, cmd, "history         List the last loaded configs with load time and hash")
+	fmt.Fprintln(w, cmd, "diff <a> [<b>]  Show the changes from config <a> to config <b> - or the running config")
+}
+
+func (c *configCommand) Invoke(ctx context.Context, w io.Writer, cmd string, args []string) (async func(), persistent string, err error) {
+	action := "show"
+	if len(args) > 0 {
+		action = args[0]
+		args = args[1:]
+	}
+
+	// entry looks up the config numbered by args[i] - or the running config.
+	entry := func(i int) (*configEntry, error) {
+		seq := 0
+		if len(args) > i {
+			var err error
+			if seq, err = strconv.Atoi(args[i]); err != nil {
+				return nil, fmt.Errorf("Bad config number: %s", args[i])
+			}
+		}
+		e := c.history.get(seq)
+		switch {
+		case e != nil:
+			return e, nil
+		case seq == 0:
+			return nil, errors.New("No config loaded")
+		default:
+			return nil, fmt.Errorf("No config %d in history", seq)
+		}
+	}
+
+	switch action {
+	case "show":
+		var e *configEntry
+		if e, err = entry(0); err != nil {
+			return
+		}
+		w.Write(e.dump)
+	case "history":
+		for i, e := range c.history.list() {
+			var running string
+			if i == 0 {
+				running = " (running)"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s%s\n", e.seq, e.loaded.Format(time.RFC3339), e.hash, running)
+		}
+	case "diff":
+		if len(args) == 0 {
+			err = errors.New("diff needs a config number")
+			return
+		}
+		var a, b *configEntry
+		if a, err = entry(0); err != nil {
+			return
+		}
+		if b, err = entry(1); err != nil {
+			return
+		}
+		err = writeConfigDiff(w, a.dump, b.dump)
+	default:
+		err = fmt.Errorf("Unknown action: %s", action)
+	}
+	return
+}
+
+// writeConfigDiff writes the changes from one dumped config to another - one
+// value per line, located by its path in the config. Lines start with "-" for removed
+// values, "+" for added values and "~" for changed values ("old -> new").
+func writeConfigDiff(w io.Writer, from, to []byte) error {
+	var a, b interface{}
+	if err := json.Unmarshal(from, &a); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(to, &b); err != nil {
+		return err
+	}
+	diffs := diffValues(nil, a, b, nil)
+	if len(diffs) == 0 {
+		fmt.Fprintln(w, "No changes")
+	}
+	for _, d := range diffs {
+		fmt.Fprintln(w, d)
+	}
+	return nil
+}
+
+// diffValues appends the differences between a and b at path to diffs.
+// Objects are compared key by key. Other values (including lists) are compared as a whole.
+func diffValues(path []string, a, b interface{}, diffs []string) []string {
+	am, aok := a.(map[string]interface{})
+	bm, bok := b.(map[string]interface{})
+	if aok && bok {
+		keys := make(map[string]bool)
+		for k := range am {
+			keys[k] = true
+		}
+		for k := range bm {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		for _, k := range sorted {
+			av, inA := am[k]
+			bv, inB := bm[k]
+			p := append(path[:len(path):len(path)], k)
+			switch {
+			case !inB:
+				diffs = append(diffs, fmt.Sprintf("- %s: %s", strings.Join(p, "."), diffValue(av)))
+			case !inA:
+				diffs = append(diffs, fmt.Sprintf("+ %s: %s", strings.Join(p, "."), diffValue(bv)))
+			default:
+				diffs = diffValues(p, av, bv, diffs)
+			}
+		}
+		return diffs
+	}
+	if !reflect.DeepEqual(a, b) {
+		diffs = append(diffs, fmt.Sprintf("~ %s: %s -> %s", strings.Join(path, "."), diffValue(a), diffValue(b)))
+	}
+	return diffs
+}
+
+func diffValue(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
@@ -0,0 +1,273 @@
+package ozone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/One-com/gone/log"
+	"github.com/One-com/gone/metric"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+var errTooManyFromIP = errors.New("Too many connections from IP")
+
+// connLimiter limits the concurrent connections of a listener. It's kept across reloads,
+// so connections still served by the previous generation of servers count too.
+// Connections beyond MaxConnections are delayed - held until a connection is closed, leaving
+// further connections in the listen queue.
+// Connections beyond MaxConnectionsPerIP from a single client IP are closed.
+type connLimiter struct {
+	mu       sync.Mutex
+	max      int
+	maxPerIP int
+	active   int
+	perIP    map[string]int
+	freed    chan struct{} // closed and replaced when a connection is released
+
+	rejected uint64 // atomic
+	delayed  uint64 // atomic
+
+	activeMeter   *metric.GaugeUint64
+	rejectedMeter *metric.Counter
+	delayedMeter  *metric.Counter
+}
+
+func newConnLimiter(server, listener string) *connLimiter {
+	prefix := server + "." + listener
+	return &connLimiter{
+		perIP:         make(map[string]int),
+		freed:         make(chan struct{}),
+		activeMeter:   metric.RegisterGauge(prefix + ".conn-active"),
+		rejectedMeter: metric.RegisterCounter(prefix + ".conn-rejected"),
+		delayedMeter:  metric.RegisterCounter(prefix + ".conn-delayed"),
+	}
+}
+
+func (l *connLimiter) setLimits(max, maxPerIP int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max, l.maxPerIP = max, maxPerIP
+	l.wake()
+}
+
+// wake wakes up any acceptors waiting for a connection to be released. Must hold mu.
+func (l *connLimiter) wake() {
+	close(l.freed)
+	l.freed = make(chan struct{})
+}
+
+// acquire counts a connection from the client ip ("" if unknown), waiting for room for it - or for done to be closed.
+func (l *connLimiter) acquire(ip string, done <-chan struct{}) error {
+	counted := false
+	for {
+		l.mu.Lock()
+		if ip != "" && l.maxPerIP != 0 && l.perIP[ip] >= l.maxPerIP {
+			l.mu.Unlock()
+			atomic.AddUint64(&l.rejected, 1)
+			l.rejectedMeter.Inc(1)
+			return errTooManyFromIP
+		}
+		if l.max == 0 || l.active < l.max {
+			l.active++
+			if ip != "" {
+				l.perIP[ip]++
+			}
+			l.activeMeter.Set(uint64(l.active))
+			l.mu.Unlock()
+			return nil
+		}
+		freed := l.freed
+		l.mu.Unlock()
+
+		if !counted {
+			atomic.AddUint64(&l.delayed, 1)
+			l.delayedMeter.Inc(1)
+			counted = true
+		}
+		select {
+		case <-freed:
+		case <-done:
+			return net.ErrClosed
+		}
+	}
+}
+
+// release gives back the room of a connection from ip.
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.activeMeter.Set(uint64(l.active))
+	if ip != "" {
+		if l.perIP[ip]--; l.perIP[ip] <= 0 {
+			delete(l.perIP, ip)
+		}
+	}
+	l.wake()
+}
+
+func (l *connLimiter) deregister() {
+	metric.Default().Deregister(l.activeMeter)
+	metric.Default().Deregister(l.rejectedMeter)
+	metric.Default().Deregister(l.delayedMeter)
+}
+
+// limitListener is a listener of a single generation of servers sharing the limiter of the listener.
+type limitListener struct {
+	net.Listener
+	limiter   *connLimiter
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *connLimiter) wrap(inner net.Listener) net.Listener {
+	return &limitListener{Listener: inner, limiter: l, done: make(chan struct{})}
+}
+
+// Accept holds on to an accepted connection until there's room for it. Connections beyond the limit
+// per IP are closed. The IP is the peer address, so per IP limits are not allowed with the PROXY protocol
+// or on UNIX sockets.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		var ip string
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+			ip = addr.IP.String()
+		}
+		switch err = l.limiter.acquire(ip, l.done); err {
+		case nil:
+			return &limitedConn{Conn: c, limiter: l.limiter, ip: ip}, nil
+		case errTooManyFromIP:
+			log.DEBUG("Connection limit per IP exceeded", "addr", c.RemoteAddr())
+			c.Close()
+		default:
+			c.Close()
+			return nil, err
+		}
+	}
+}
+
+func (l *limitListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// limitedConn releases its room in the limiter when closed.
+type limitedConn struct {
+	net.Conn
+	limiter   *connLimiter
+	ip        string
+	closeOnce sync.Once
+}
+
+func (c *limitedConn) Close() error {
+	c.closeOnce.Do(func() { c.limiter.release(c.ip) })
+	return c.Conn.Close()
+}
+
+// connLimiters are the limiters of the listeners with connection limits - by server and listener.
+type connLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]map[string]*connLimiter
+}
+
+var listenerLimits = &connLimiters{limiters: make(map[string]map[string]*connLimiter)}
+
+// get returns the limiter of a listener - making it if new.
+func (c *connLimiters) get(server, listener string) *connLimiter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.limiters[server] == nil {
+		c.limiters[server] = make(map[string]*connLimiter)
+	}
+	l := c.limiters[server][listener]
+	if l == nil {
+		l = newConnLimiter(server, listener)
+		c.limiters[server][listener] = l
+	}
+	return l
+}
+
+// retain forgets the limiters of listeners not configured with limits.
+// Connections still open keep using their limiter.
+func (c *connLimiters) retain(servers config.HTTPServersConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for server, limiters := range c.limiters {
+		for listener, l := range limiters {
+			lcfg, ok := servers[server].Listeners[listener]
+			if !ok || (lcfg.MaxConnections == 0 && lcfg.MaxConnectionsPerIP == 0) {
+				l.deregister()
+				delete(limiters, listener)
+			}
+		}
+		if len(limiters) == 0 {
+			delete(c.limiters, server)
+		}
+	}
+}
+
+// reset forgets all limiters.
+func (c *connLimiters) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, limiters := range c.limiters {
+		for _, l := range limiters {
+			l.deregister()
+		}
+	}
+	c.limiters = make(map[string]map[string]*connLimiter)
+}
+
+// ---------------------------------------------------------------
+// A control socket command showing the connection limits
+
+var connectionsControl = &connectionsCommand{}
+
+type connectionsCommand struct{}
+
+func (c *connectionsCommand) ShortUsage() (syntax, comment string) {
+	comment = "show connections and rejections of listeners with connection limits"
+	return
+}
+
+func (c *connectionsCommand) Usage(cmd string, w io.Writer) {
+	fmt.Fprintln(w, cmd, "lists \"<server> <listener> <active>/<max> <per IP max> <clients> <rejected> <delayed>\" for listeners with connection limits")
+}
+
+func (c *connectionsCommand) Invoke(ctx context.Context, w io.Writer, cmd string, args []string) (async func(), persistent string, err error) {
+	listenerLimits.mu.Lock()
+	defer listenerLimits.mu.Unlock()
+
+	servers := make([]string, 0, len(listenerLimits.limiters))
+	for server := range listenerLimits.limiters {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		limiters := listenerLimits.limiters[server]
+		listeners := make([]string, 0, len(limiters))
+		for listener := range limiters {
+			listeners = append(listeners, listener)
+		}
+		sort.Strings(listeners)
+		for _, listener := range listeners {
+			l := limiters[listener]
+			l.mu.Lock()
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\t%d\t%d\t%d\t%d\n", server, listener, l.active, l.max, l.maxPerIP, len(l.perIP),
+				atomic.LoadUint64(&l.rejected), atomic.LoadUint64(&l.delayed))
+			l.mu.Unlock()
+		}
+	}
+	return
+}
@@ -0,0 +1,1157 @@
+package ozone_test
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/One-com/gone/jconf"
+	"golang.org/x/net/http2"
+
+	"github.com/One-com/ozone/v2"
+	"github.com/One-com/ozone/v2/handlers/router"
+	"github.com/One-com/ozone/v2/ozonetest"
+)
+
+// Tests running the daemon. Listeners use port 0 and ozonetest tells where they listen.
+
+const teststring = "test ok\n"
+
+var ozoneTestHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(teststring))
+})
+
+type replyConfig struct {
+	Reply string
+}
+
+func createReplyHandler(name string, js jconf.SubConfig, handlerByName func(string) (http.Handler, error)) (h http.Handler, cleanup func() error, err error) {
+	var cfg *replyConfig
+	err = js.ParseInto(&cfg)
+	if err != nil {
+		return
+	}
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(cfg.Reply))
+	})
+	return
+}
+
+type wrapConfig struct {
+	Handler string
+}
+
+func createWrapHandler(name string, js jconf.SubConfig, handlerByName func(string) (http.Handler, error)) (h http.Handler, cleanup func() error, err error) {
+	var cfg *wrapConfig
+	err = js.ParseInto(&cfg)
+	if err != nil {
+		return
+	}
+	h2, e := handlerByName(cfg.Handler)
+	if e != nil {
+		err = e
+		return
+	}
+	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h2.ServeHTTP(w, r)
+	})
+	return
+}
+
+var remoteAddrHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.RemoteAddr))
+})
+
+func init() {
+	ozone.RegisterStaticHTTPHandler("OzoneTest", ozoneTestHandler)
+	ozone.RegisterStaticHTTPHandler("RemoteAddr", remoteAddrHandler)
+	ozone.RegisterHTTPHandlerType("reply", createReplyHandler)
+	ozone.RegisterHTTPHandlerType("wrap", createWrapHandler)
+}
+
+func get(t *testing.T, url string) string {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+//----------------------------------------------------
+
+var stopconfig = `{
+    "HTTP" : {
+        "TestServer" : {
+            "Listeners" : {
+                "http" : {
+                    "Port" : 0
+                }
+            },
+            "Handler" : "NotFound"
+        }
+    }
+}
+`
+
+// TestStop just tests the stop function.
+func TestStop(t *testing.T) {
+	d := ozonetest.Start(t, stopconfig)
+	d.Stop()
+}
+
+//----------------------------------------------------
+
+var answerRequestConfig = `{
+    "HTTP" : {
+        "HelloServer" : {
+            "Listeners" : {
+                "http" : {
+                    "Port" : 0
+                }
+            },
+            "Handler" : "OzoneTest"
+        }
+    }
+}
+`
+
+// TestAnswerRequest verifies that a handler can respond to requests
+func TestAnswerRequest(t *testing.T) {
+	d := ozonetest.Start(t, answerRequestConfig)
+
+	if get(t, d.URL("HelloServer", "http")) != teststring {
+		t.Error("No ok response")
+	}
+}
+
+//----------------------------------------------------
+
+// Test a proxy which puts 2 HTTP servers in a backend cluster.
+// Test that there's a reasonable load balancing between the two servers.
+
+var proxyConfig = `{
+    "HTTP" : {
+        "ProxyServer" : {
+            "Listeners" : {
+                "http" : {
+                    "Port" : 0
+                }
+            },
+            "Handler" : "theproxy"
+        }
+    },
+    "Handlers" : {
+        "theproxy" : {
+             "Type" : "ReverseProxy",
+             "Config" : {
+                "Transport" : {
+                    "Type" : "Virtual",
+                    "Config" : {
+                        "Type" : "RoundRobin",
+                        "Retries" : 1,
+                        "MaxFails" : 2,
+                        "Quarantine": "1m",
+                        "BackendPin": "10s",
+                        "RoutingKeyHeader": "X-PinKey",
+                        "Upstreams": {
+                            "cluster" : [ "%s/", "%s/" ]
+                        }
+                    }
+                },
+                "ModuleOrder" : ["director", "rewrites"],
+                "Modules": {
+                    "director" : {
+                        "Type": "forward_map_director",
+                        "Config": {
+                            "Forward": {
+                                "" : "vt://cluster"
+                            }
+                        }
+                    },
+                    "rewrites" : {
+                        "Type": "proxypass",
+                        "Config": {
+                            "RewriteHost" : false,
+                            "RewriteForward" : false,
+                            "RewriteReverse" : false
+                        }
+                    }
+                }
+            }
+        }
+    }
+}
+`
+
+func TestProxy(t *testing.T) {
+	var backends []*httptest.Server
+	for _, reply := range []string{"1", "2"} {
+		reply := reply
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(reply))
+		}))
+		defer backend.Close()
+		backends = append(backends, backend)
+	}
+
+	d := ozonetest.Start(t, fmt.Sprintf(proxyConfig, backends[0].URL, backends[1].URL))
+
+	var replies []string
+	for i := 0; i < 10; i++ {
+		replies = append(replies, get(t, d.URL("ProxyServer", "http")))
+	}
+	d.Stop()
+
+	var c1, c2 int
+	var maxdiff = 2
+	for _, r := range replies {
+		switch r {
+		case "1":
+			c1++
+		case "2":
+			c2++
+		default:
+			t.Fail()
+		}
+	}
+	if c2-c1 > maxdiff || c1-c2 > maxdiff {
+		t.Error("Proxy cluster not balanced")
+	}
+}
+
+//----------------------------------------------------------------
+
+var recursiveConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Port" : 0
+                }
+            },
+            "Handler" : "handler1"
+        }
+    },
+    "Handlers" : {
+        "handler1" : {
+             "Type" : "wrap",
+             "Config" : {
+                   "Handler" : "handler2"
+              }
+        },
+        "handler2" : {
+             "Type" : "wrap",
+             "Config" : {
+                   "Handler" : "handler3"
+              }
+        },
+        "handler3" : {
+             "Type" : "reply",
+             "Config" : {
+                    "Reply" : "3"
+              }
+        }
+    }
+}
+`
+
+func TestHandlerResolution(t *testing.T) {
+	d := ozonetest.Start(t, recursiveConfig)
+
+	if get(t, d.URL("Main", "http")) != "3" {
+		t.Error("No ok response")
+	}
+}
+
+//----------------------------------------------------------------
+
+// TestReloadDaemon verifies reloading through the control socket.
+func TestReloadDaemon(t *testing.T) {
+	d := ozonetest.Start(t, recursiveConfig)
+	addr := d.Addr("Main", "http")
+
+	out := d.Reload(strings.Replace(recursiveConfig, `"Reply" : "3"`, `"Reply" : "three"`, 1))
+	if !strings.HasPrefix(out, "OK\nRestarted: Main") {
+		t.Fatalf("Unexpected reload output: %q", out)
+	}
+	if reply := get(t, d.URL("Main", "http")); reply != "three" {
+		t.Errorf("Reload not serving new config: %s", reply)
+	}
+	if d.Addr("Main", "http") != addr {
+		t.Errorf("Port 0 listener not kept across reload: %s -> %s", addr, d.Addr("Main", "http"))
+	}
+	_, port, _ := net.SplitHostPort(addr)
+	if servers := d.Control("servers"); !strings.HasPrefix(servers, "Main\thttp\t") || !strings.HasSuffix(servers, ":"+port+"\n") {
+		t.Errorf("Unexpected servers output: %q", servers)
+	}
+
+	out = d.Reload(`{ "HTTP" : { "Main" : { "Handler" : "nosuchhandler" } } }`)
+	if !strings.HasPrefix(out, "HTTP.Main.Handler") || !strings.HasSuffix(out, "Error:  Reload failed\n") {
+		t.Errorf("Unexpected reload output: %q", out)
+	}
+}
+
+//----------------------------------------------------------------
+
+var unixConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "file" : {
+                    "Network" : "unix",
+                    "Path" : "%s",
+                    "Mode" : "0600"
+                },
+                "abstract" : {
+                    "Network" : "unix",
+                    "Path" : "%s"
+                },
+                "ipv6" : {
+                    "Network" : "tcp6",
+                    "Address" : "::1",
+                    "Port" : 0
+                }
+            },
+            "Handler" : "OzoneTest"
+        }
+    }
+}
+`
+
+// TestUnixListeners verifies listening on UNIX sockets - also after a reload.
+func TestUnixListeners(t *testing.T) {
+	if _, err := net.Listen("tcp6", "[::1]:0"); err != nil {
+		t.Skip("No IPv6 loopback")
+	}
+	path := filepath.Join(t.TempDir(), "ozone.sock")
+	abstract := fmt.Sprintf("@ozonetest-unix-%d", os.Getpid())
+	cfg := fmt.Sprintf(unixConfig, path, abstract)
+
+	// A stale socket file is removed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	d := ozonetest.Start(t, cfg)
+
+	if d.Addr("Main", "file") != path || d.Addr("Main", "abstract") != abstract {
+		t.Errorf("Bad UNIX socket addresses: %s, %s", d.Addr("Main", "file"), d.Addr("Main", "abstract"))
+	}
+
+	unixGet := func(listener string) string {
+		t.Helper()
+		resp, err := d.Client("Main", listener).Get(d.URL("Main", listener))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	for i := 0; i < 2; i++ {
+		if reply := unixGet("file"); reply != teststring {
+			t.Errorf("Bad reply on socket file: %q", reply)
+		}
+		if reply := unixGet("abstract"); reply != teststring {
+			t.Errorf("Bad reply on abstract socket: %q", reply)
+		}
+		if reply := get(t, d.URL("Main", "ipv6")); reply != teststring {
+			t.Errorf("Bad reply on IPv6: %q", reply)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("Bad socket file mode: %s", fi.Mode())
+		}
+
+		out := d.Reload(strings.Replace(cfg, "OzoneTest", "NotFound", 1))
+		if !strings.HasPrefix(out, "OK") {
+			t.Fatal(out)
+		}
+		cfg = strings.Replace(cfg, "NotFound", "OzoneTest", 1)
+		d.Reload(cfg)
+	}
+
+	// A removed socket file is bound again on reload
+	os.Remove(path)
+	d.Reload(cfg)
+	if reply := unixGet("file"); reply != teststring {
+		t.Errorf("Bad reply on socket file bound again: %q", reply)
+	}
+
+	// The socket file is removed when the previous generation has closed its listener
+	if out := d.Reload(fmt.Sprintf(unixConfig, path+".new", abstract)); !strings.HasPrefix(out, "OK") {
+		t.Fatal(out)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		_, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Errorf("Socket file of removed listener not removed: %v", err)
+			break
+		}
+	}
+	d.Reload(cfg)
+	d.Stop()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Socket file not removed on stop: %v", err)
+	}
+}
+
+//----------------------------------------------------------------
+
+var proxyProtocolConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0,
+                    "ProxyProtocol" : {
+                        "Mode" : "required",
+                        "Trusted" : [ "127.0.0.0/8" ]
+                    }
+                }
+            },
+            "Handler" : "RemoteAddr"
+        }
+    }
+}
+`
+
+// TestProxyProtocol verifies that handlers see the client address from the PROXY protocol header.
+func TestProxyProtocol(t *testing.T) {
+	d := ozonetest.Start(t, proxyProtocolConfig)
+
+	conn, err := net.Dial("tcp", d.Addr("Main", "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "PROXY TCP4 192.0.2.1 127.0.0.1 56324 80\r\nGET / HTTP/1.0\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "192.0.2.1:56324" {
+		t.Errorf("Handler didn't see the client address: %s", data)
+	}
+
+	// The header is required
+	if _, err := http.Get(d.URL("Main", "http")); err == nil {
+		t.Error("Expected request without PROXY protocol header to fail")
+	}
+}
+
+//----------------------------------------------------------------
+
+var h2cConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0
+                }
+            },
+            "Handler" : "Proto",
+            "HTTP2" : {
+                "H2C" : true,
+                "MaxConcurrentStreams" : 10
+            }
+        }
+    }
+}
+`
+
+var protoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(r.Proto))
+})
+
+func init() {
+	ozone.RegisterStaticHTTPHandler("Proto", protoHandler)
+}
+
+// TestH2C verifies cleartext HTTP/2 with prior knowledge.
+func TestH2C(t *testing.T) {
+	d := ozonetest.Start(t, h2cConfig)
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get(d.URL("Main", "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "HTTP/2.0" {
+		t.Errorf("Expected HTTP/2.0, got %s", data)
+	}
+
+	if proto := get(t, d.URL("Main", "http")); proto != "HTTP/1.1" {
+		t.Errorf("Expected HTTP/1.1 to still work, got %s", proto)
+	}
+}
+
+//----------------------------------------------------------------
+
+var reusePortConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0,
+                    "ReusePort" : true,
+                    "Acceptors" : %d,
+                    "Backlog" : 64,
+                    "ReadBuffer" : 65536,
+                    "WriteBuffer" : 65536,
+                    "KeepAlive" : "30s",
+                    "NoDelay" : false,
+                    "DeferAccept" : "1s",
+                    "FastOpen" : 16
+                }
+            },
+            "Handler" : "OzoneTest"
+        }
+    }
+}
+`
+
+// listeningSockets counts the IPv4 sockets listening on the port.
+func listeningSockets(t *testing.T, port string) (count int) {
+	t.Helper()
+	data, err := ioutil.ReadFile("/proc/net/tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	local := fmt.Sprintf(":%04X", p)
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) > 3 && strings.HasSuffix(fields[1], local) && fields[3] == "0A" {
+			count++
+		}
+	}
+	return
+}
+
+// TestReusePort verifies listening with more SO_REUSEPORT acceptor sockets and socket options.
+func TestReusePort(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Socket options only supported on Linux")
+	}
+	// 0 acceptors is without ReusePort
+	reusePort := func(acceptors int) string {
+		cfg := fmt.Sprintf(reusePortConfig, acceptors)
+		if acceptors == 0 {
+			cfg = strings.Replace(cfg, `"ReusePort" : true`, `"ReusePort" : false`, 1)
+		}
+		return cfg
+	}
+	d := ozonetest.Start(t, reusePort(0))
+	addr := d.Addr("Main", "http")
+	_, port, _ := net.SplitHostPort(addr)
+
+	// ReusePort is toggled on the listening socket.
+	for _, acceptors := range []int{3, 2, 4, 0, 1, 0} {
+		out := d.Reload(reusePort(acceptors))
+		if !strings.HasPrefix(out, "OK") {
+			t.Fatal(out)
+		}
+		if d.Addr("Main", "http") != addr {
+			t.Errorf("Port not kept across reload: %s -> %s", addr, d.Addr("Main", "http"))
+		}
+		if n := listeningSockets(t, port); n != acceptors && !(acceptors == 0 && n == 1) {
+			t.Errorf("Expected %d listening sockets, got %d", acceptors, n)
+		}
+		for i := 0; i < 2*acceptors+1; i++ {
+			// Defer accept waits for data - which the request sends.
+			if reply := get(t, d.URL("Main", "http")); reply != teststring {
+				t.Errorf("Bad reply: %q", reply)
+			}
+		}
+	}
+}
+
+//----------------------------------------------------------------
+
+var connLimitConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "perip" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0,
+                    "MaxConnectionsPerIP" : 1
+                },
+                "total" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0,
+                    "MaxConnections" : 1
+                }
+            },
+            "Handler" : "OzoneTest"
+        }
+    }
+}
+`
+
+// request sends a request on a kept-alive connection, returning a channel delivering the response body.
+func request(t *testing.T, c net.Conn) <-chan string {
+	t.Helper()
+	if _, err := c.Write([]byte("GET / HTTP/1.1\r\nHost: ozone\r\n\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make(chan string, 1)
+	go func() {
+		resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+		if err != nil {
+			reply <- err.Error()
+			return
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		reply <- string(data)
+	}()
+	return reply
+}
+
+// TestConnectionLimits verifies that connections beyond the limits are delayed or closed.
+func TestConnectionLimits(t *testing.T) {
+	d := ozonetest.Start(t, connLimitConfig)
+
+	dial := func(listener string) net.Conn {
+		t.Helper()
+		c, err := net.Dial("tcp", d.Addr("Main", listener))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	// A second connection from the same IP is closed.
+	c1 := dial("perip")
+	if reply := <-request(t, c1); reply != teststring {
+		t.Fatalf("Bad reply: %q", reply)
+	}
+	c2 := dial("perip")
+	c2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c2.Read(make([]byte, 1)); n != 0 || err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected connection over the limit per IP to be closed: %d %v", n, err)
+	}
+	c2.Close()
+	c1.Close()
+
+	// A second connection is served when the first is closed.
+	c1 = dial("total")
+	if reply := <-request(t, c1); reply != teststring {
+		t.Fatalf("Bad reply: %q", reply)
+	}
+	c2 = dial("total")
+	defer c2.Close()
+	delayed := request(t, c2)
+	select {
+	case reply := <-delayed:
+		t.Fatalf("Expected connection over the limit to be delayed, got %q", reply)
+	case <-time.After(200 * time.Millisecond):
+	}
+	c1.Close()
+	select {
+	case reply := <-delayed:
+		if reply != teststring {
+			t.Errorf("Bad reply: %q", reply)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Delayed connection not served")
+	}
+
+	// The server closes its end of the connections closed by the client when it notices.
+	expected := "Main\tperip\t0/0\t1\t0\t1\t0\nMain\ttotal\t1/1\t0\t1\t0\t1\n"
+	var out string
+	for i := 0; i < 50 && out != expected; i++ {
+		time.Sleep(10 * time.Millisecond)
+		out = d.Control("connections")
+	}
+	if out != expected {
+		t.Errorf("Unexpected connections output: %q", out)
+	}
+}
+
+//----------------------------------------------------------------
+
+var minRateConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0,
+                    "MinReadRate" : 1000,
+                    "MinRateWindow" : "200ms"
+                },
+                "https" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0,
+                    "MinReadRate" : 1000,
+                    "MinRateWindow" : "200ms",
+                    "TLS" : {
+                        "CipherSuites" : { "Format" : "hex", "Ciphers" : "c02b" },
+                        "Certificates" : { "test" : { "CrtPEMFile" : %q, "KeyPEMFile" : %q } }
+                    }
+                }
+            },
+            "Handler" : {
+                "/" : "OzoneTest",
+                "/echo" : "Echo"
+            }
+        }
+    }
+}
+`
+
+// writeCertificate writes a self signed certificate for 127.0.0.1 and its key to dir.
+func writeCertificate(t *testing.T, dir string) (crtFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ozonetest"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crtFile, keyFile = filepath.Join(dir, "test.crt"), filepath.Join(dir, "test.key")
+	if err = os.WriteFile(crtFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+// TestMinRate verifies that a client sending a request too slowly is disconnected.
+func TestMinRate(t *testing.T) {
+	crtFile, keyFile := writeCertificate(t, t.TempDir())
+	d := ozonetest.Start(t, fmt.Sprintf(minRateConfig, crtFile, keyFile))
+
+	// Waiting for the next request on a kept-alive connection is not slow.
+	for i := 0; i < 2; i++ {
+		if reply := get(t, d.URL("Main", "http")); reply != teststring {
+			t.Errorf("Bad reply: %q", reply)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+
+	// Neither is waiting after the TLS handshake.
+	tc, err := tls.Dial("tcp", d.Addr("Main", "https"), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	time.Sleep(300 * time.Millisecond)
+	fmt.Fprint(tc, "GET / HTTP/1.1\r\nHost: ozone\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(tc), nil)
+	if err != nil {
+		t.Fatalf("TLS connection closed waiting for the first request: %s", err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != teststring {
+		t.Errorf("Bad reply over TLS: %q", data)
+	}
+
+	c, err := net.Dial("tcp", d.Addr("Main", "http"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Dribble a request body a byte at a time until the connection is closed.
+	// Slow request headers are left to the ReadHeaderTimeout.
+	closed := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 1))
+		closed <- err
+	}()
+	body := strings.Repeat("x", 100)
+	fmt.Fprintf(c, "POST /echo HTTP/1.1\r\nHost: ozone\r\nContent-Length: %d\r\n\r\n", len(body))
+	for i := 0; i < len(body); i++ {
+		select {
+		case err := <-closed:
+			if err == nil {
+				t.Fatal("Expected slow connection to be closed, got data")
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+		c.Write([]byte{body[i]})
+	}
+	t.Fatal("Slow connection not closed")
+}
+
+//----------------------------------------------------------------
+
+var echoHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(data)
+})
+
+func init() {
+	ozone.RegisterStaticHTTPHandler("Echo", echoHandler)
+}
+
+var sizeLimitConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0
+                }
+            },
+            "Handler" : {
+                "/" : "Echo",
+                "/small" : "small"
+            },
+            "MaxHeaderBytes" : 1024,
+            "MaxRequestBody" : 10,
+            "MaxRequestBodyError" : "too big"
+        }
+    },
+    "Handlers" : {
+        "small" : {
+            "Type" : "wrap",
+            "MaxRequestBody" : 3,
+            "Config" : {
+                "Handler" : "Echo"
+            }
+        }
+    }
+}
+`
+
+// TestRequestSizeLimits verifies limits of request headers and bodies of servers and handlers.
+func TestRequestSizeLimits(t *testing.T) {
+	d := ozonetest.Start(t, sizeLimitConfig)
+
+	tests := []struct {
+		path    string
+		body    string
+		chunked bool
+		status  int
+		reply   string
+	}{
+		{"/", "0123456789", false, 200, "0123456789"},
+		{"/", "0123456789a", false, 413, "too big"},
+		{"/", "0123456789a", true, 413, "too big"},
+		{"/small", "012", true, 200, "012"},
+		{"/small", "0123", true, 413, "Request Entity Too Large\n"},
+	}
+	for _, test := range tests {
+		var body io.Reader = strings.NewReader(test.body)
+		if test.chunked {
+			// Hide the length
+			body = io.MultiReader(body)
+		}
+		resp, err := http.Post(d.URL("Main", "http")+test.path, "text/plain", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.status || string(data) != test.reply {
+			t.Errorf("%s %q: Expected %d %q, got %d %q", test.path, test.body, test.status, test.reply, resp.StatusCode, data)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", d.URL("Main", "http"), nil)
+	req.Header.Set("X-Large", strings.Repeat("x", 8192))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected %d for large header, got %d", http.StatusRequestHeaderFieldsTooLarge, resp.StatusCode)
+	}
+}
+
+//----------------------------------------------------------------
+
+var drainConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0
+                }
+            },
+            "Handler" : {
+                "/health" : "Health",
+                "/ready" : "Ready"
+            }
+        }
+    }
+}
+`
+
+// status returns the status code and body of a GET request.
+func status(t *testing.T, url string) (int, string) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(data)
+}
+
+// TestDrain verifies that the daemon reports not being ready for the drain delay before closing
+// the listeners on a graceful shutdown.
+func TestDrain(t *testing.T) {
+	d := ozonetest.Start(t, drainConfig, ozone.DrainDelay(500*time.Millisecond))
+	url := d.URL("Main", "http")
+
+	if code, body := status(t, url+"/ready"); code != http.StatusOK || body != "ready\n" {
+		t.Errorf("Ready before stop: %d %q", code, body)
+	}
+
+	d.Control("daemon", "stop")
+
+	if code, body := status(t, url+"/ready"); code != http.StatusServiceUnavailable || body != "draining\n" {
+		t.Errorf("Ready while draining: %d %q", code, body)
+	}
+	if code, body := status(t, url+"/health"); code != http.StatusOK || body != "draining\n" {
+		t.Errorf("Health while draining: %d %q", code, body)
+	}
+
+	http.DefaultClient.CloseIdleConnections()
+
+	// The servers stop serving after the delay.
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := client.Get(url + "/health")
+		if err != nil {
+			return
+		}
+		resp.Body.Close()
+		client.CloseIdleConnections()
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Error("Still serving after the drain delay")
+}
+
+//----------------------------------------------------------------
+
+func init() {
+	// "Append" adds its config string to the X-Chain response header.
+	ozone.RegisterMiddlewareType("Append", func(js jconf.SubConfig, next http.Handler) (http.Handler, error) {
+		var value string
+		if err := js.ParseInto(&value); err != nil {
+			return nil, err
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("X-Chain", value)
+			next.ServeHTTP(w, r)
+		}), nil
+	})
+	ozone.RegisterStaticHTTPHandler("Panic", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("test panic")
+	}))
+}
+
+var middlewareConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0
+                }
+            },
+            "Handler" : {
+                "/" : "Echo",
+                "/panic" : "Panic",
+                "/tagged" : "tagged"
+            },
+            "Middleware" : [
+                { "Type" : "Append", "Config" : "a" },
+                { "Type" : "Recover" },
+                { "Type" : "Headers", "Config" : { "Response" : { "X-Server" : "ozone" } } },
+                { "Type" : "Append", "Config" : "b" }
+            ]
+        }
+    },
+    "Handlers" : {
+        "tagged" : {
+            "Type" : "wrap",
+            "Middleware" : [
+                { "Type" : "Append", "Config" : "c" }
+            ],
+            "Config" : {
+                "Handler" : "Echo"
+            }
+        }
+    }
+}
+`
+
+// TestMiddleware verifies that server and handler middleware wrap handlers in the configured order.
+func TestMiddleware(t *testing.T) {
+	d := ozonetest.Start(t, middlewareConfig)
+	url := d.URL("Main", "http")
+
+	tests := []struct {
+		path  string
+		code  int
+		chain string
+	}{
+		{"/", http.StatusOK, "a,b"},
+		{"/tagged", http.StatusOK, "a,b,c"},
+		{"/panic", http.StatusInternalServerError, "a,b"},
+	}
+	for _, test := range tests {
+		resp, err := http.Get(url + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.code {
+			t.Errorf("%s: Expected status %d, got %d", test.path, test.code, resp.StatusCode)
+		}
+		if chain := strings.Join(resp.Header.Values("X-Chain"), ","); chain != test.chain {
+			t.Errorf("%s: Expected middleware chain %q, got %q", test.path, test.chain, chain)
+		}
+		if resp.Header.Get("X-Server") != "ozone" {
+			t.Errorf("%s: Missing X-Server header", test.path)
+		}
+	}
+}
+
+//----------------------------------------------------------------
+
+func init() {
+	ozone.RegisterStaticHTTPHandler("UserID", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, router.Param(r, "id"))
+	}))
+}
+
+var routerConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0
+                }
+            },
+            "Handler" : "routes"
+        }
+    },
+    "Handlers" : {
+        "routes" : {
+            "Type" : "Router",
+            "Config" : {
+                "Rules" : [
+                    { "Methods" : ["GET"], "Path" : "/users/{id}", "Handler" : "UserID" },
+                    { "Path" : "/echo", "Handler" : "Echo" }
+                ]
+            }
+        }
+    }
+}
+`
+
+// TestRouter verifies that the Router handler type dispatches requests and exposes path parameters.
+func TestRouter(t *testing.T) {
+	d := ozonetest.Start(t, routerConfig)
+	url := d.URL("Main", "http")
+
+	if reply := get(t, url+"/users/42"); reply != "42" {
+		t.Errorf("Expected the user id, got %q", reply)
+	}
+	resp, err := http.Post(url+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(data) != "hello" {
+		t.Errorf("Expected echo, got %q", data)
+	}
+	resp, err = http.Post(url+"/users/42", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected 404 for unrouted method, got %d", resp.StatusCode)
+	}
+}
@@ -27,6 +27,41 @@ Running Ozone requires a JSON configuration file. (the file allows "//" comments
    }
 
 Handler types are made available either by being built in, registered from code or loaded from plugins.
+The DumpSchema Option writes a JSON Schema for the config. Handler types, TLS plugin types and reverse proxy
+modules registering the struct their config is parsed into (RegisterHTTPHandlerSchema, RegisterTLSPluginSchema,
+rproxy.RegisterReverseProxyModuleSchema) have their config included in the schema.
+
+Applications building the config in Go - or fetching it from their own source - can call
+MainWithConfigProvider with a function returning the config instead of Main. The function is called
+on start and on every reload.
+
+Config files can also be written in YAML (".yaml", ".yml") or TOML (".toml"). The format is given
+by the file extension - or the ConfigFormat Option. Such files are converted to JSON before being parsed,
+so they have the same structure and handler configs are parsed the same way whatever the format.
+
+Large configs can be split in several files. The top level "Include" list names files, directories or
+glob patterns (relative to the including file) to merge into the config. If the config file given is a directory,
+all config files in it are merged in lexical order. Servers, handlers and TLS plugins can only be defined once
+across all files. A file included by several files is only loaded once.
+
+   {
+      "Include" : [ "conf.d" ],
+      "HTTP" : { ... }
+   }
+
+Values can be kept out of the config file. Any JSON string value can reference environment variables,
+files and systemd credentials (from $CREDENTIALS_DIRECTORY), which are substituted before the config
+(and all handler and module sub configs) is parsed. Use "$${" for a literal "${".
+String values with values from files and credentials substituted are redacted when the config is dumped.
+
+   "Upstreams" : { "api" : [ "${ENV:API_BACKEND}" ] },
+   "KeyPEMFile" : "${CREDENTIAL:tls-key-path}",
+   "Password" : "${FILE:/etc/ozone/secret}"
+
+Reloading (SIGHUP) only rebuilds the handlers and servers whose config changed. A handler config also
+changes when a file its type reads (like a certificate or CA file - see RegisterHTTPHandlerFiles) has a
+new size or modification time. Unchanged handlers are kept with their state - like reverse proxy upstream
+quarantines and health checks - and so are the access logs of unchanged servers.
 
 */
 package ozone
@@ -42,6 +42,7 @@ func main() {
 
 	ozone.RegisterStaticHTTPHandler("statichandler", staticHandler)
 	ozone.RegisterHTTPHandlerType("configurable", createHandler)
+	ozone.RegisterHTTPHandlerSchema("configurable", &handlerConfig{})
 
 	err := ozone.Main(configFile)
 	if err != nil {
@@ -3,6 +3,7 @@ module github.com/One-com/ozone/v2
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/One-com/gone v0.0.0-20210510055705-059b1e22b0b6
 	github.com/One-com/gone/daemon v1.0.0
 	github.com/One-com/gone/http v1.0.0
@@ -11,12 +12,15 @@ require (
 	github.com/One-com/gone/netutil v1.0.0
 	github.com/One-com/gone/sd v1.0.0
 	github.com/One-com/gone/signals v1.0.0
+	github.com/andybalholm/brotli v1.0.5
+	github.com/klauspost/compress v1.16.7
 	github.com/pkg/errors v0.9.1
 	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4
+	golang.org/x/net v0.0.0-20220425223048-2871e0cb64e4
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
-	golang.org/x/net v0.0.0-20220425223048-2871e0cb64e4 // indirect
 	golang.org/x/text v0.3.7 // indirect
 )
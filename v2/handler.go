@@ -10,20 +10,24 @@ import (
 	"github.com/One-com/gone/daemon"
 	"github.com/One-com/gone/jconf"
 	"github.com/One-com/gone/log"
+	"github.com/One-com/gone/metric"
 
 	"github.com/One-com/ozone/v2/config"
+	"github.com/One-com/ozone/v2/handlers/router"
 	"github.com/One-com/ozone/v2/handlers/rproxy"
+	"github.com/One-com/ozone/v2/handlers/static"
 )
 
 // HandlerConfigureFunc is called to create a http.Handler from a JSON config stanza. Each registered handler type must define such a function.
 // The function is passed a way to lookup other handlers by name of it needs to wrap around them.
 type HandlerConfigureFunc func(name string, cfg jconf.SubConfig, lookupHandler func(string) (http.Handler, error)) (handler http.Handler, cleanup func() error, err error)
 
-
 // global statically configured handlers and handlertypes
 var handlerTypes = map[string]HandlerConfigureFunc{}
 var staticHandlers = map[string]http.Handler{
 	"NotFound": http.NotFoundHandler(),
+	"Health":   healthHandler,
+	"Ready":    readyHandler,
 }
 
 // RegisterHTTPHandlerType defines a handler type, so it can be used in the
@@ -35,6 +39,22 @@ func RegisterHTTPHandlerType(typename string, f HandlerConfigureFunc) {
 	handlerTypes[typename] = f
 }
 
+// HandlerFilesFunc returns the files read by a handler configured from cfg. Reloading rebuilds
+// the handler when any of them has changed - even if its config hasn't.
+type HandlerFilesFunc func(cfg jconf.SubConfig) []string
+
+// handlerFiles are the HandlerFilesFunc of handler types reading files when configured.
+var handlerFiles = map[string]HandlerFilesFunc{
+	"ReverseProxy": rproxy.ConfigFiles,
+}
+
+// RegisterHTTPHandlerFiles declares the files read by handlers of a type - like certificates.
+// Handlers of types without files are only rebuilt on reload when their config changes.
+// Not go-routine safe.
+func RegisterHTTPHandlerFiles(typename string, f HandlerFilesFunc) {
+	handlerFiles[typename] = f
+}
+
 // RegisterStaticHTTPHandler makes it possible to directly reference an stdlib HTTP handler
 // in the config file and from other handlers generated dynamically from config.
 // Such handlers are not configurable. If you want to be able to configure
@@ -48,29 +68,72 @@ func RegisterStaticHTTPHandler(name string, h http.Handler) {
 // When configuring a handler it is passed a handlerByName() function which
 // lets it lookup another named handler. Handlers can use handlerByName() to recursively
 // resolve other handlers.
+// Handlers failing to configure are reported once in the registry errors at the path
+// of their config. Handlers referencing them just fail with a dependencyError.
+// Handlers are kept from the previous generation if their config and all handlers
+// they depend on are unchanged.
 type handlerRegistry struct {
-	resolutionMap  map[string]http.Handler
-	cfg            config.HandlersConfig
-
-	cleanups       []daemon.CleanupFunc
-	services       []daemon.Server
-	resolutionPath []string // to detect handler cycles
+	resolutionMap map[string]http.Handler
+	cfg           config.HandlersConfig
+	validate      bool // don't register metrics for handlers only built to validate config
+	gen           *generation
+
+	errs           config.Errors
+	failed         map[string]bool
+	built          map[string]bool // handlers not kept from the previous generation
+	resolutionPath []string        // to detect handler cycles
+	deps           *[]string       // records handlers resolved by the component being built
 }
 
-func newHandlerRegistry(cfg config.HandlersConfig) (r *handlerRegistry) {
-	r = &handlerRegistry{cfg: cfg}
+func newHandlerRegistry(cfg config.HandlersConfig, validate bool, gen *generation) (r *handlerRegistry) {
+	r = &handlerRegistry{cfg: cfg, validate: validate, gen: gen}
 	r.resolutionMap = make(map[string]http.Handler)
+	r.failed = make(map[string]bool)
+	r.built = make(map[string]bool)
 	return
 }
 
-func (r *handlerRegistry) Services() []daemon.Server {
-	return r.services
+// Services returns the services of all handlers resolved.
+func (r *handlerRegistry) Services() (services []daemon.Server) {
+	for _, name := range r.cfg.Names() {
+		if c := r.gen.handlers[name]; c != nil && c.service != nil {
+			services = append(services, c.service)
+		}
+	}
+	return
+}
+
+// Errors returns the errors of all handlers which failed to configure - or nil.
+func (r *handlerRegistry) Errors() error {
+	return r.errs.Err()
+}
+
+// resolveSpec creates a http.Handler based on the handlerSpec like HandlerForSpec and
+// returns the names of the handlers resolved.
+func (r *handlerRegistry) resolveSpec(srvName string, handlerSpec interface{}) (handler http.Handler, deps []string, err error) {
+	outer := r.deps
+	r.deps = &deps
+	defer func() { r.deps = outer }()
+	handler, err = r.HandlerForSpec(srvName, handlerSpec)
+	return
 }
-func (r *handlerRegistry) Cleanups() []daemon.CleanupFunc {
-	return r. cleanups
+
+// unchanged resolves the handlers named by deps and tells whether they were all kept from
+// the previous generation.
+func (r *handlerRegistry) unchanged(deps []string) bool {
+	outer := r.deps
+	r.deps = nil
+	defer func() { r.deps = outer }()
+	for _, dep := range deps {
+		if _, err := r.handlerByName(dep); err != nil || r.built[dep] {
+			return false
+		}
+	}
+	return true
 }
 
 // HandlerForSpec creates a http.Handler based on the provided handlerSpec by looking up the config.
+// Errors are located relative to the handler spec.
 func (r *handlerRegistry) HandlerForSpec(srvName string, handlerSpec interface{}) (handler http.Handler, err error) {
 
 	// Create a HTTP Handler for the Service.
@@ -79,28 +142,32 @@ func (r *handlerRegistry) HandlerForSpec(srvName string, handlerSpec interface{}
 		// Single Handler for all URLs
 		handler, err = r.handlerByName(handlerKind)
 		if err != nil {
-			err = fmt.Errorf("Handler(%s): %s", handlerKind, err.Error())
+			err = fmt.Errorf("Handler(%s): %w", handlerKind, err)
 		}
 	case map[string]interface{}:
 		// Set up a serve mux Handler mapping several handlers to URLs
 		mhandler := http.NewServeMux()
+		var errs config.Errors
 		for path, handlerIName := range handlerKind {
 			var phandler http.Handler // handler for a specific URL path
+			var e error
 			switch handlerName := handlerIName.(type) {
 			case string:
-				phandler, err = r.handlerByName(handlerName)
-				if err != nil {
-					err = fmt.Errorf("Handler(%s): %s", handlerName, err.Error())
+				phandler, e = r.handlerByName(handlerName)
+				if e != nil {
+					e = fmt.Errorf("Handler(%s): %w", handlerName, e)
 				}
 			default:
-				err = fmt.Errorf("Handlername must be string for service %s, was: %v", srvName, handlerName)
+				e = fmt.Errorf("Handlername must be string for service %s, was: %v", srvName, handlerName)
 			}
-			if err != nil {
-				return
+			if e != nil {
+				collectError(&errs, e, path)
+				continue
 			}
 			mhandler.Handle(path, phandler)
 		}
-		if err != nil {
+		if len(errs) != 0 {
+			err = errs
 			return
 		}
 		handler = mhandler
@@ -116,11 +183,19 @@ func (r *handlerRegistry) HandlerForSpec(srvName string, handlerSpec interface{}
 // else configure it - if possible and return it.
 func (r *handlerRegistry) handlerByName(name string) (handler http.Handler, err error) {
 
+	if r.deps != nil {
+		*r.deps = append(*r.deps, name)
+	}
+
 	// If we already have resolved this handler, return it.
 	var ok bool
 	if handler, ok = r.resolutionMap[name]; ok {
 		return
 	}
+	if r.failed[name] {
+		err = &dependencyError{kind: "Handler", name: name}
+		return
+	}
 
 	// See if we can configure it from the handlers config.
 	// if that fails, return any static handler with that name.
@@ -148,44 +223,76 @@ func (r *handlerRegistry) handlerByName(name string) (handler http.Handler, err
 		r.resolutionPath = r.resolutionPath[:pathlen]
 	}()
 
+	// Keep the handler from the previous generation if nothing changed.
+	fingerprint := handlerFingerprint(&cfg)
+	if prev := r.gen.previousHandler(name, fingerprint); prev != nil && r.unchanged(prev.deps) {
+		r.gen.handlers[name] = prev
+		r.resolutionMap[name] = prev.handler
+		if cfg.Config != nil && prev.config != nil {
+			cfg.Config.Parsed = prev.config.Parsed
+		}
+		handler = prev.handler
+		return
+	}
+
 	// We didn't have the handler ready. Configure the handler from config.
-	var cleanupfuncs []daemon.CleanupFunc
+	comp := &component{fingerprint: fingerprint}
 	var cf daemon.CleanupFunc
 	var handlerservice daemon.Server
 
+	outer := r.deps
+	r.deps = &comp.deps
 	handler, handlerservice, cf, err = r.handlerForConfig(name, &cfg)
+	r.deps = outer
 	if err != nil {
+		collectError(&r.errs, err, "Handlers", name)
+		r.failed[name] = true
+		err = &dependencyError{kind: "Handler", name: name}
 		return
 	}
+	r.built[name] = true
 	if cf != nil {
 		// appending to a slice, since we might add another below in wrapping
-		cleanupfuncs = append(cleanupfuncs, cf)
+		comp.cleanups = append(comp.cleanups, cf)
+	}
+	if handlerservice != nil {
+		comp.service = &persistentService{Server: handlerservice}
 	}
 	if handler != nil {
+		var tooLarge *metric.Counter
+		if !r.validate {
+			tooLarge = tooLargeCounter(name, cfg.Metrics)
+		}
+		handler = limitRequestBody(handler, cfg.MaxRequestBody, cfg.MaxRequestBodyError, tooLarge)
+
 		mcfg := cfg.Metrics
 		// If this handler has metrics enabled, wrap an extra audithandler.
-		if mcfg != "" {
+		if mcfg != "" && !r.validate {
 			mfunc := metricsFunction(name, mcfg)
 
 			var logcleanup daemon.CleanupFunc
 			handler, logcleanup = wrapAuditHandler("", handler, "", mfunc) // no accesslog here
 			if logcleanup != nil {
-				cleanupfuncs = append(cleanupfuncs, logcleanup)
+				comp.cleanups = append(comp.cleanups, logcleanup)
 			}
 		}
 		// Store the handler for later lookup to avoid re-initializing
 		r.resolutionMap[name] = handler
 	}
-
-	if handlerservice != nil {
-		r.services = append(r.services, handlerservice)
-	}
-	r.cleanups = append(r.cleanups, cleanupfuncs...)
+	comp.handler = handler
+	comp.config = cfg.Config
+	r.gen.handlers[name] = comp
 	return
 }
 
+// handlerForConfig configures a handler. Errors are located relative to the handler config.
 func (r *handlerRegistry) handlerForConfig(name string, cfg *config.HandlerConfig) (handler http.Handler, service daemon.Server, cleanup daemon.CleanupFunc, err error) {
 
+	if cfg.MaxRequestBody < 0 {
+		err = config.AtPath(errors.New("MaxRequestBody must not be negative"), "MaxRequestBody")
+		return
+	}
+
 	// Load the handler from a plugin
 	if cfg.Plugin != "" {
 		handler, cleanup, err = r.handlerFromPlugin(name, cfg)
@@ -208,14 +315,43 @@ func (r *handlerRegistry) handlerForConfig(name string, cfg *config.HandlerConfi
 				}
 				handler = proxy
 			}
+			err = config.AtPath(err, "Config")
 		case "Redirect":
 			handler, err = makeRedirectHandler(cfg.Config)
+			err = config.AtPath(err, "Config")
+		case "Static":
+			var st *static.Handler
+			st, err = static.New(cfg.Config)
+			if err == nil {
+				handler = st
+			}
+			err = config.AtPath(err, "Config")
+		case "Router":
+			var rt *router.Router
+			rt, err = router.New(cfg.Config, r.handlerByName)
+			if err == nil {
+				handler = rt
+			}
+			err = config.AtPath(err, "Config")
 		default:
 			if hinit, ok := handlerTypes[cfg.Type]; ok {
-				h, c, e := hinit(name, cfg.Config, r.handlerByName)
-				return h, nil, c, e
+				handler, cleanup, err = hinit(name, cfg.Config, r.handlerByName)
+				err = config.AtPath(err, "Config")
+				break
+			}
+			err = config.AtPath(fmt.Errorf("No such Handler type: %s", cfg.Type), "Type")
+		}
+	}
+
+	if err == nil && handler != nil && len(cfg.Middleware) != 0 {
+		handler, err = wrapMiddleware(handler, cfg.Middleware)
+		if err != nil {
+			if cleanup != nil {
+				cleanup()
+				cleanup = nil
 			}
-			err = fmt.Errorf("No such Handler type: %s", cfg.Type)
+			service = nil
+			err = config.AtPath(err, "Middleware")
 		}
 	}
 
@@ -227,12 +363,12 @@ func (r *handlerRegistry) handlerForConfig(name string, cfg *config.HandlerConfi
 func (r *handlerRegistry) handlerFromPlugin(name string, cfg *config.HandlerConfig) (handler http.Handler, cleanup func() error, err error) {
 	abspath, e := filepath.Abs(cfg.Plugin)
 	if e != nil {
-		err = e
+		err = config.AtPath(e, "Plugin")
 		return
 	}
 	p, e := plugin.Open(abspath)
 	if e != nil {
-		err = e
+		err = config.AtPath(e, "Plugin")
 		return
 	}
 
@@ -245,24 +381,17 @@ func (r *handlerRegistry) handlerFromPlugin(name string, cfg *config.HandlerConf
 
 	m := s.(*map[string]HandlerConfigureFunc)
 	if m == nil {
-		err = errors.New("Defect handler plugin")
+		err = config.AtPath(errors.New("Defect handler plugin"), "Plugin")
+		return
 	}
 
 	f := (*m)[cfg.Type]
 	if f == nil {
-		err = errors.New("Defect handler plugin type initialization function")
-	}
-
-	return f(name, cfg.Config, r.handlerByName)
-}
-
-func makeRedirectHandler(js jconf.SubConfig) (handler http.Handler, err error) {
-	cfg := new(config.RedirectHandlerConfig)
-	err = js.ParseInto(&cfg)
-	if err != nil {
+		err = config.AtPath(errors.New("Defect handler plugin type initialization function"), "Type")
 		return
 	}
 
-	handler = http.RedirectHandler(cfg.URL, cfg.Code)
+	handler, cleanup, err = f(name, cfg.Config, r.handlerByName)
+	err = config.AtPath(err, "Config")
 	return
 }
@@ -0,0 +1,284 @@
+// Package compress compresses HTTP responses with gzip, brotli or zstd - negotiated by the
+// Accept-Encoding header of requests.
+//
+// It's used by the "Compress" middleware of servers and handlers and by the "compress" reverse proxy
+// module compressing uncompressed backend responses.
+package compress
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// Defaults of Config.
+var (
+	DefaultEncodings    = []string{"br", "zstd", "gzip"}
+	DefaultMinSize      = 1024
+	DefaultContentTypes = []string{
+		"text/*",
+		"application/json",
+		"application/*+json",
+		"application/javascript",
+		"application/xml",
+		"application/*+xml",
+		"image/svg+xml",
+	}
+)
+
+// Config defines JSON for configuring response compression.
+//
+// Encodings are the encodings ("br", "zstd", "gzip") to use - in order of preference when the client
+// accepts more of them equally. Responses smaller than MinSize bytes and responses of content types
+// not in ContentTypes ("type/subtype" - possibly with "*" wildcards) are not compressed.
+// The levels are those of each encoding - 0 meaning its default.
+type Config struct {
+	Encodings    []string `json:",omitempty"`
+	MinSize      *int     `json:",omitempty"`
+	ContentTypes []string `json:",omitempty"`
+	GzipLevel    int      `json:",omitempty"`
+	BrotliLevel  int      `json:",omitempty"`
+	ZstdLevel    int      `json:",omitempty"`
+}
+
+// Compressor compresses responses as configured.
+type Compressor struct {
+	encoders     map[string]*encoder
+	preference   []string
+	minSize      int
+	contentTypes []string
+}
+
+// New makes a Compressor from its JSON config.
+// Errors are located (as config.PathError) relative to the config.
+func New(js jconf.SubConfig) (*Compressor, error) {
+	var cfg *Config
+	if err := js.ParseInto(&cfg); err != nil {
+		return nil, err
+	}
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	return NewFromConfig(cfg)
+}
+
+// NewFromConfig makes a Compressor from a parsed config.
+func NewFromConfig(cfg *Config) (*Compressor, error) {
+	c := &Compressor{
+		encoders:     make(map[string]*encoder),
+		preference:   cfg.Encodings,
+		minSize:      DefaultMinSize,
+		contentTypes: cfg.ContentTypes,
+	}
+	if c.preference == nil {
+		c.preference = DefaultEncodings
+	}
+	if cfg.MinSize != nil {
+		c.minSize = *cfg.MinSize
+	}
+	if c.contentTypes == nil {
+		c.contentTypes = DefaultContentTypes
+	}
+
+	var errs config.Errors
+	if c.minSize < 0 {
+		errs.Add(config.AtPath(errors.New("MinSize must not be negative"), "MinSize"))
+	}
+	levels := map[string]struct {
+		level int
+		field string
+	}{
+		"gzip": {cfg.GzipLevel, "GzipLevel"},
+		"br":   {cfg.BrotliLevel, "BrotliLevel"},
+		"zstd": {cfg.ZstdLevel, "ZstdLevel"},
+	}
+	for i, name := range c.preference {
+		l, ok := levels[name]
+		if !ok {
+			errs.Add(config.AtPath(fmt.Errorf("Unknown encoding: %s", name), "Encodings", strconv.Itoa(i)))
+			continue
+		}
+		enc, err := newEncoder(name, l.level)
+		if err != nil {
+			errs.Add(config.AtPath(err, l.field))
+			continue
+		}
+		c.encoders[name] = enc
+	}
+	for i, ct := range c.contentTypes {
+		if !strings.Contains(ct, "/") {
+			errs.Add(config.AtPath(fmt.Errorf("Invalid content type: %s", ct), "ContentTypes", strconv.Itoa(i)))
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return c, nil
+}
+
+// negotiate returns the encoder to use for the Accept-Encoding header of a request - or nil.
+// The encoding with the highest q-value wins. Ties are broken by the configured preference.
+func (c *Compressor) negotiate(acceptEncoding string) *encoder {
+	if acceptEncoding == "" {
+		return nil
+	}
+	qs := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				v, err := strconv.ParseFloat(param[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			qs[name] = q
+		}
+	}
+
+	var best *encoder
+	bestQ := 0.0
+	for _, name := range c.preference {
+		q, ok := qs[name]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = c.encoders[name], q
+		}
+	}
+	return best
+}
+
+// compressible tells whether responses of the content type are compressed.
+func (c *Compressor) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range c.contentTypes {
+		if matchContentType(strings.ToLower(pattern), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchContentType matches a media type against a pattern where a "*" matches any text without "/".
+func matchContentType(pattern, mediaType string) bool {
+	star := strings.IndexByte(pattern, '*')
+	if star < 0 {
+		return pattern == mediaType
+	}
+	prefix, suffix := pattern[:star], pattern[star+1:]
+	if len(mediaType) < len(prefix)+len(suffix) {
+		return false
+	}
+	return strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix) &&
+		!strings.Contains(mediaType[len(prefix):len(mediaType)-len(suffix)], "/")
+}
+
+// addVary adds Accept-Encoding to the Vary header - unless already there.
+func addVary(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, field := range strings.Split(v, ",") {
+			field = strings.TrimSpace(field)
+			if field == "*" || strings.EqualFold(field, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// ---------------------------------------------------------------
+// Encoders
+
+// writer is a compressing writer of an encoding.
+type writer interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+// encoder pools the writers of an encoding.
+type encoder struct {
+	name string
+	pool sync.Pool
+}
+
+func newEncoder(name string, level int) (*encoder, error) {
+	enc := &encoder{name: name}
+	switch name {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if _, err := gzip.NewWriterLevel(io.Discard, level); err != nil {
+			return nil, err
+		}
+		enc.pool.New = func() interface{} {
+			w, _ := gzip.NewWriterLevel(io.Discard, level)
+			return w
+		}
+	case "br":
+		if level == 0 {
+			level = brotli.DefaultCompression
+		}
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("Invalid brotli level: %d", level)
+		}
+		enc.pool.New = func() interface{} {
+			return brotli.NewWriterLevel(io.Discard, level)
+		}
+	case "zstd":
+		zlevel := zstd.SpeedDefault
+		if level != 0 {
+			if level < 1 || level > 22 {
+				return nil, fmt.Errorf("Invalid zstd level: %d", level)
+			}
+			zlevel = zstd.EncoderLevelFromZstd(level)
+		}
+		enc.pool.New = func() interface{} {
+			w, _ := zstd.NewWriter(io.Discard, zstd.WithEncoderLevel(zlevel), zstd.WithEncoderConcurrency(1))
+			return w
+		}
+	default:
+		return nil, fmt.Errorf("Unknown encoding: %s", name)
+	}
+	return enc, nil
+}
+
+// get returns a writer compressing to w. Put it back when closed.
+func (e *encoder) get(w io.Writer) writer {
+	cw := e.pool.Get().(writer)
+	cw.Reset(w)
+	return cw
+}
+
+func (e *encoder) put(cw writer) {
+	cw.Reset(io.Discard)
+	e.pool.Put(cw)
+}
@@ -0,0 +1,308 @@
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+func newCompressor(t *testing.T, js string) *Compressor {
+	t.Helper()
+	var cfg *jconf.OptionalSubConfig
+	if err := json.Unmarshal([]byte(js), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func decode(t *testing.T, encoding string, data []byte) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = gr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(data))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return string(data)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestNegotiate(t *testing.T) {
+	c := newCompressor(t, `{}`)
+	tests := []struct {
+		accept   string
+		expected string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip, br;q=0.5", "gzip"},
+		{"zstd, gzip", "zstd"},
+		{"br;q=0, *", "zstd"},
+		{"*;q=0", ""},
+		{"GZIP;q=0.1", "gzip"},
+	}
+	for _, test := range tests {
+		enc := c.negotiate(test.accept)
+		name := ""
+		if enc != nil {
+			name = enc.name
+		}
+		if name != test.expected {
+			t.Errorf("%q: Expected %q, got %q", test.accept, test.expected, name)
+		}
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	c := newCompressor(t, `{ "MinSize" : 100, "GzipLevel" : 9, "ZstdLevel" : 3 }`)
+	large := strings.Repeat("compressible text ", 100)
+
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		encoding    string // response Content-Encoding set by the handler
+		body        string
+		expected    string // expected Content-Encoding
+	}{
+		{"brotli", "br, gzip", "text/plain", "", large, "br"},
+		{"gzip", "gzip", "text/html; charset=utf-8", "", large, "gzip"},
+		{"zstd", "zstd", "application/problem+json", "", large, "zstd"},
+		{"sniffed", "gzip", "", "", "<html>" + large, "gzip"},
+		{"small", "gzip", "text/plain", "", "small", ""},
+		{"type", "gzip", "image/png", "", large, ""},
+		{"encoded", "gzip", "text/plain", "br", large, "br"},
+		{"not accepted", "", "text/plain", "", large, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := c.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if test.contentType != "" {
+					w.Header().Set("Content-Type", test.contentType)
+				}
+				if test.encoding != "" {
+					w.Header().Set("Content-Encoding", test.encoding)
+				}
+				w.Header().Set("ETag", `"v1"`)
+				// Write in pieces to have the start buffered.
+				io.WriteString(w, test.body[:len(test.body)/2])
+				io.WriteString(w, test.body[len(test.body)/2:])
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			if test.accept != "" {
+				req.Header.Set("Accept-Encoding", test.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			encoding := w.Header().Get("Content-Encoding")
+			if encoding != test.expected {
+				t.Fatalf("Expected Content-Encoding %q, got %q", test.expected, encoding)
+			}
+			if test.encoding == "" {
+				if body := decode(t, encoding, w.Body.Bytes()); body != test.body {
+					t.Errorf("Bad body: %q", body)
+				}
+			}
+			if test.expected != "" && test.encoding == "" {
+				if w.Header().Get("Vary") != "Accept-Encoding" || w.Header().Get("ETag") != `W/"v1"` {
+					t.Errorf("Bad headers: %v", w.Header())
+				}
+			}
+		})
+	}
+}
+
+// flushRecorder records the data flushed.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []int
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushed = append(r.flushed, r.Body.Len())
+	r.ResponseRecorder.Flush()
+}
+
+func TestMiddlewareFlush(t *testing.T) {
+	c := newCompressor(t, `{ "Encodings" : ["gzip"] }`)
+	h := c.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: 1\n\n")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "data: 2\n\n")
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(w, req)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected streamed response to be compressed: %v", w.Header())
+	}
+	if len(w.flushed) != 1 || w.flushed[0] == 0 {
+		t.Fatalf("Expected data flushed, got %v", w.flushed)
+	}
+	// The flushed data decompresses to the first event.
+	zr, err := gzip.NewReader(bytes.NewReader(w.Body.Bytes()[:w.flushed[0]]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, 9)
+	if _, err = io.ReadFull(zr, first); err != nil || string(first) != "data: 1\n\n" {
+		t.Errorf("Bad flushed data: %q %v", first, err)
+	}
+	if body := decode(t, "gzip", w.Body.Bytes()); body != "data: 1\n\ndata: 2\n\n" {
+		t.Errorf("Bad body: %q", body)
+	}
+}
+
+func TestCompressResponse(t *testing.T) {
+	c := newCompressor(t, `{ "MinSize" : 10 }`)
+	large := strings.Repeat("backend data ", 100)
+
+	tests := []struct {
+		name          string
+		contentLength int64
+		contentType   string
+		expected      string
+	}{
+		{"known length", int64(len(large)), "application/json", "br"},
+		{"unknown length", -1, "text/plain", "br"},
+		{"small", 5, "text/plain", ""},
+		{"type", -1, "application/octet-stream", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip, br")
+			resp := &http.Response{
+				StatusCode:    200,
+				Header:        http.Header{"Content-Type": {test.contentType}},
+				ContentLength: test.contentLength,
+				Body:          io.NopCloser(strings.NewReader(large)),
+			}
+			if test.contentLength >= 0 {
+				resp.Header.Set("Content-Length", "1300")
+			}
+			c.CompressResponse(req, resp)
+
+			encoding := resp.Header.Get("Content-Encoding")
+			if encoding != test.expected {
+				t.Fatalf("Expected Content-Encoding %q, got %q", test.expected, encoding)
+			}
+			data, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body := decode(t, encoding, data); body != large {
+				t.Errorf("Bad body: %q", body)
+			}
+			if encoding != "" && (resp.ContentLength != -1 || resp.Header.Get("Content-Length") != "") {
+				t.Errorf("Content-Length not removed: %d %v", resp.ContentLength, resp.Header)
+			}
+		})
+	}
+}
+
+// TestCompressResponseStream verifies that what's compressed is flushed when the backend pauses.
+func TestCompressResponseStream(t *testing.T) {
+	c := newCompressor(t, `{ "Encodings" : ["gzip"] }`)
+	pr, pw := io.Pipe()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": {"text/event-stream"}},
+		ContentLength: -1,
+		Body:          pr,
+	}
+	c.CompressResponse(req, resp)
+	defer resp.Body.Close()
+
+	go io.WriteString(pw, "data: 1\n\n")
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, 9)
+	if _, err = io.ReadFull(zr, first); err != nil || string(first) != "data: 1\n\n" {
+		t.Fatalf("Bad first event: %q %v", first, err)
+	}
+
+	go func() {
+		io.WriteString(pw, "data: 2\n\n")
+		pw.Close()
+	}()
+	rest, err := io.ReadAll(zr)
+	if err != nil || string(rest) != "data: 2\n\n" {
+		t.Errorf("Bad rest of body: %q %v", rest, err)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	var cfg *jconf.OptionalSubConfig
+	if err := json.Unmarshal([]byte(`{
+        "MinSize" : -1,
+        "Encodings" : ["gzip", "lzma", "br"],
+        "BrotliLevel" : 12,
+        "ContentTypes" : ["text"]
+    }`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	_, err := New(cfg)
+	errs, ok := err.(config.Errors)
+	if !ok {
+		t.Fatalf("Expected config.Errors, got %T: %v", err, err)
+	}
+	expected := []string{"MinSize", "Encodings.1", "BrotliLevel", "ContentTypes.0"}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %s", len(expected), len(errs), err)
+	}
+	for i, e := range errs {
+		var pe *config.PathError
+		if !errors.As(e, &pe) {
+			t.Fatalf("Error not located by path: %s", e)
+		}
+		if path := strings.Join(pe.Path, "."); path != expected[i] {
+			t.Errorf("Expected error at %s, got %s", expected[i], path)
+		}
+	}
+}
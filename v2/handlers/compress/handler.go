@@ -0,0 +1,284 @@
+package compress
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Wrap returns a handler compressing the responses of next.
+func (c *Compressor) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cw := &responseWriter{
+			ResponseWriter: w,
+			c:              c,
+			enc:            c.negotiate(r.Header.Get("Accept-Encoding")),
+			head:           r.Method == http.MethodHead,
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// eligible tells whether a response with the status and headers could be compressed - ignoring its
+// content type and size.
+func eligible(status int, h http.Header) bool {
+	switch {
+	case status < 200, status == http.StatusNoContent, status == http.StatusNotModified, status == http.StatusPartialContent:
+		return false
+	case h.Get("Content-Encoding") != "", h.Get("Content-Range") != "":
+		return false
+	}
+	return true
+}
+
+// prepare sets the headers of a response being compressed by enc.
+func prepare(h http.Header, enc *encoder) {
+	h.Set("Content-Encoding", enc.name)
+	h.Del("Content-Length")
+	// The compressed content is not byte for byte the same.
+	if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		h.Set("ETag", "W/"+etag)
+	}
+}
+
+// responseWriter buffers the start of a response until it can tell whether to compress it.
+// That's when MinSize bytes are written, when the handler flushes - or when it's done.
+type responseWriter struct {
+	http.ResponseWriter
+	c    *Compressor
+	enc  *encoder // nil if the client accepts no encoding
+	head bool
+
+	status  int    // 0 until WriteHeader
+	decided bool   // the header is written
+	buf     []byte // written before deciding
+	cw      writer // compressing writer if compressing
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.status != 0 || w.decided {
+		return
+	}
+	if code < 200 {
+		// Informational responses pass through.
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+
+	// Don't wait for responses which are not going to be compressed.
+	h := w.Header()
+	if w.head || !eligible(code, h) {
+		w.decide(false)
+		return
+	}
+	if cl := h.Get("Content-Length"); cl != "" {
+		if n, err := strconv.Atoi(cl); err == nil && n < w.c.minSize {
+			w.decide(false)
+		}
+	}
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.decided {
+		if w.cw != nil {
+			return w.cw.Write(b)
+		}
+		return w.ResponseWriter.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.c.minSize {
+		if err := w.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide writes the header - compressing if the response is eligible and allowed by the size - and
+// writes the buffered start of the response.
+func (w *responseWriter) decide(sizeOK bool) (err error) {
+	if w.decided {
+		return
+	}
+	w.decided = true
+
+	h := w.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) != 0 {
+		// Sniff the content type like the server would - before compressing.
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if w.head || eligible(w.status, h) {
+		if w.c.compressible(h.Get("Content-Type")) {
+			addVary(h)
+			if sizeOK && w.enc != nil && !w.head {
+				prepare(h, w.enc)
+				w.cw = w.enc.get(w.ResponseWriter)
+			}
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(w.status)
+	if len(w.buf) != 0 {
+		if w.cw != nil {
+			_, err = w.cw.Write(w.buf)
+		} else {
+			_, err = w.ResponseWriter.Write(w.buf)
+		}
+		w.buf = nil
+	}
+	return
+}
+
+// Flush compresses what's written so far - streaming responses are compressed regardless of size.
+func (w *responseWriter) Flush() {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	w.decide(true)
+	if w.cw != nil {
+		w.cw.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, errors.New("Hijacking not supported")
+}
+
+// close ends the response when the handler is done.
+func (w *responseWriter) close() {
+	if w.status == 0 {
+		// Nothing written. Leave it to the server.
+		return
+	}
+	w.decide(false)
+	if w.cw != nil {
+		w.cw.Close()
+		w.enc.put(w.cw)
+		w.cw = nil
+	}
+}
+
+// ---------------------------------------------------------------
+// Compressing responses of a reverse proxy
+
+// CompressResponse makes the body of a response to the request compressed, if the response is
+// eligible and the client accepts a configured encoding. The body is compressed as it's read -
+// flushing when waiting for more of the original body to keep streamed responses flowing.
+func (c *Compressor) CompressResponse(req *http.Request, resp *http.Response) {
+	if req.Method == http.MethodHead || !eligible(resp.StatusCode, resp.Header) ||
+		!c.compressible(resp.Header.Get("Content-Type")) {
+		return
+	}
+	addVary(resp.Header)
+	if resp.ContentLength >= 0 && resp.ContentLength < int64(c.minSize) {
+		return
+	}
+	enc := c.negotiate(req.Header.Get("Accept-Encoding"))
+	if enc == nil {
+		return
+	}
+	prepare(resp.Header, enc)
+	resp.ContentLength = -1
+	resp.Body = newCompressedBody(resp.Body, enc)
+}
+
+// compressedBody reads the compressed body through a pipe from a go-routine compressing it.
+type compressedBody struct {
+	*io.PipeReader
+	body io.ReadCloser
+}
+
+// chunk is read from the original body.
+type chunk struct {
+	data []byte
+	err  error
+}
+
+// newCompressedBody compresses the body as it's read. The compressed data is flushed only when
+// no more of the original body is ready, so a body read in small parts compresses like a whole.
+func newCompressedBody(body io.ReadCloser, enc *encoder) io.ReadCloser {
+	pr, pw := io.Pipe()
+	chunks := make(chan chunk)
+	done := make(chan struct{})
+	// Two buffers let the next part be read while the last is compressed.
+	free := make(chan []byte, 2)
+	free <- make([]byte, 32*1024)
+	free <- make([]byte, 32*1024)
+
+	go func() {
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			n, err := body.Read(buf)
+			select {
+			case chunks <- chunk{data: buf[:n], err: err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	go func() {
+		defer close(done)
+		cw := enc.get(pw)
+		defer enc.put(cw)
+		c := <-chunks
+		for {
+			if len(c.data) > 0 {
+				if _, err := cw.Write(c.data); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			free <- c.data[:cap(c.data)]
+			if c.err == io.EOF {
+				pw.CloseWithError(cw.Close())
+				return
+			}
+			if c.err != nil {
+				pw.CloseWithError(c.err)
+				return
+			}
+			select {
+			case c = <-chunks:
+				continue
+			default:
+			}
+			// Waiting for the original body. Let the client have what's compressed so far.
+			if err := cw.Flush(); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			c = <-chunks
+		}
+	}()
+	return &compressedBody{PipeReader: pr, body: body}
+}
+
+// Close stops the compressing go-routine - with an error writing to the closed pipe.
+func (b *compressedBody) Close() error {
+	b.PipeReader.Close()
+	return b.body.Close()
+}
@@ -0,0 +1,140 @@
+// Package router implements the "Router" handler type dispatching requests to named handlers by
+// ordered rules matching the host, method, path, headers, query, cookies and source address of requests.
+//
+// Paths are matched by patterns of "/" separated segments. A "{name}" segment matches any single
+// segment and a last "{name...}" segment matches the rest of the path - capturing them as path
+// parameters. A pattern ending in "/" matches all paths below it, like http.ServeMux.
+// Paths can also be matched by a regular expression capturing its named groups as parameters.
+// Handlers get the parameters by Params.
+package router
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// Config defines JSON for configuring the "Router" handler type.
+// Rules are tried by descending Priority - in the order given for equal priorities.
+// Requests matching no rule are passed to the NotFound handler - or get a 404.
+type Config struct {
+	Rules    []RuleConfig
+	NotFound string `json:",omitempty"`
+}
+
+// RuleConfig defines a rule sending matching requests to Handler. All the conditions given must match.
+// Hosts are host names - possibly with a "*." prefix matching any sub domain - or "*".
+// Headers, Query and Cookies map names to regular expressions matching all of the value.
+// An empty expression just requires the header, query parameter or cookie to be present.
+// Sources are CIDRs or IP addresses matching the client address.
+type RuleConfig struct {
+	Hosts     []string          `json:",omitempty"`
+	Methods   []string          `json:",omitempty"`
+	Path      string            `json:",omitempty"`
+	PathRegex string            `json:",omitempty"`
+	Headers   map[string]string `json:",omitempty"`
+	Query     map[string]string `json:",omitempty"`
+	Cookies   map[string]string `json:",omitempty"`
+	Sources   []string          `json:",omitempty"`
+	Priority  int               `json:",omitempty"`
+	Handler   string
+}
+
+// Router is a http.Handler dispatching requests by the first rule matching.
+type Router struct {
+	rules    []*rule
+	notFound http.Handler
+}
+
+// New makes a Router from its JSON config - looking up the handlers of the rules by name.
+// Errors are located (as config.PathError) relative to the router config.
+func New(js jconf.SubConfig, lookup func(string) (http.Handler, error)) (router *Router, err error) {
+	var cfg *Config
+	err = js.ParseInto(&cfg)
+	if err != nil {
+		return
+	}
+	if cfg == nil {
+		err = errors.New("Missing Router config")
+		return
+	}
+
+	router = &Router{notFound: http.NotFoundHandler()}
+	var errs config.Errors
+	for i := range cfg.Rules {
+		r, e := newRule(&cfg.Rules[i], lookup)
+		if e != nil {
+			errs.Add(config.AtPath(e, "Rules", strconv.Itoa(i)))
+			continue
+		}
+		router.rules = append(router.rules, r)
+	}
+	if cfg.NotFound != "" {
+		h, e := lookup(cfg.NotFound)
+		if e != nil {
+			errs.Add(config.AtPath(fmt.Errorf("Handler(%s): %w", cfg.NotFound, e), "NotFound"))
+		}
+		router.notFound = h
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+
+	sort.SliceStable(router.rules, func(i, j int) bool {
+		return router.rules[i].priority > router.rules[j].priority
+	})
+	return
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, rule := range router.rules {
+		params, ok := rule.match(r)
+		if !ok {
+			continue
+		}
+		if len(params) != 0 {
+			r = withParams(r, params)
+		}
+		rule.handler.ServeHTTP(w, r)
+		return
+	}
+	router.notFound.ServeHTTP(w, r)
+}
+
+// ---------------------------------------------------------------
+// Path parameters
+
+type paramsKey struct{}
+
+// Params returns the path parameters captured by the routers having dispatched the request - or nil.
+// Parameters captured by an inner router replace those of an outer router with the same name.
+func Params(r *http.Request) map[string]string {
+	params, _ := r.Context().Value(paramsKey{}).(map[string]string)
+	return params
+}
+
+// Param returns the path parameter name captured by the routers having dispatched the request - or "".
+func Param(r *http.Request, name string) string {
+	return Params(r)[name]
+}
+
+func withParams(r *http.Request, params map[string]string) *http.Request {
+	if outer := Params(r); len(outer) != 0 {
+		merged := make(map[string]string, len(outer)+len(params))
+		for k, v := range outer {
+			merged[k] = v
+		}
+		for k, v := range params {
+			merged[k] = v
+		}
+		params = merged
+	}
+	return r.WithContext(context.WithValue(r.Context(), paramsKey{}, params))
+}
@@ -0,0 +1,163 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+var routerConfig = `{
+    "Rules" : [
+        { "Hosts" : ["*.example.com"], "Path" : "/", "Handler" : "wildcard" },
+        { "Hosts" : ["example.com"], "Methods" : ["POST"], "Path" : "/users/{id}", "Handler" : "postuser" },
+        { "Path" : "/users/{id}", "Handler" : "user" },
+        { "Path" : "/users/{id}/files/{path...}", "Handler" : "files" },
+        { "Path" : "/static/", "Handler" : "static" },
+        { "PathRegex" : "^/v(?P<version>[0-9]+)/", "Handler" : "versioned" },
+        { "Path" : "/api/", "Headers" : { "X-Api-Key" : "" }, "Handler" : "api" },
+        { "Path" : "/api/", "Query" : { "debug" : "1|true" }, "Cookies" : { "session" : "[a-z]+" }, "Handler" : "debug" },
+        { "Path" : "/admin", "Sources" : ["10.0.0.0/8", "192.0.2.1"], "Handler" : "admin" },
+        { "Path" : "/users/me", "Priority" : 10, "Handler" : "me" }
+    ],
+    "NotFound" : "notfound"
+}`
+
+// lookup returns handlers writing their name and the path parameters.
+func lookup(name string) (http.Handler, error) {
+	if name == "missing" {
+		return nil, errors.New("No such handler")
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		params := Params(r)
+		keys := make([]string, 0, len(params))
+		for k := range params {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		fmt.Fprint(w, name)
+		for _, k := range keys {
+			fmt.Fprintf(w, " %s=%s", k, params[k])
+		}
+	}), nil
+}
+
+func subConfig(t *testing.T, js string) jconf.SubConfig {
+	t.Helper()
+	var cfg *jconf.OptionalSubConfig
+	if err := json.Unmarshal([]byte(js), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRouter(t *testing.T) {
+	router, err := New(subConfig(t, routerConfig), lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, url string
+		header      string // "Name: value"
+		remote      string
+		expected    string
+	}{
+		{"GET", "http://www.example.com/users/1", "", "", "wildcard"},
+		{"POST", "http://example.com:8080/users/1", "", "", "postuser id=1"},
+		{"GET", "http://example.com/users/1", "", "", "user id=1"},
+		{"GET", "http://example.com/users/", "", "", "notfound"},
+		{"GET", "http://example.com/users/1/", "", "", "notfound"},
+		{"GET", "http://example.com/users/1/files/a/b.txt", "", "", "files id=1 path=a/b.txt"},
+		{"GET", "http://example.com/users/1/files/", "", "", "files id=1 path="},
+		{"GET", "http://example.com/static/css/site.css", "", "", "static"},
+		{"GET", "http://example.com/static", "", "", "notfound"},
+		{"GET", "http://example.com/v2/things", "", "", "versioned version=2"},
+		{"GET", "http://example.com/api/x", "X-Api-Key: secret", "", "api"},
+		{"GET", "http://example.com/api/x?debug=true", "Cookie: session=abc", "", "debug"},
+		{"GET", "http://example.com/api/x?debug=yes", "Cookie: session=abc", "", "notfound"},
+		{"GET", "http://example.com/api/x?debug=1", "Cookie: session=ABC", "", "notfound"},
+		{"GET", "http://example.com/admin", "", "10.1.2.3:5000", "admin"},
+		{"GET", "http://example.com/admin", "", "192.0.2.1:5000", "admin"},
+		{"GET", "http://example.com/admin", "", "192.0.2.2:5000", "notfound"},
+		{"GET", "http://example.com/users/me", "", "", "me"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, nil)
+		if test.header != "" {
+			kv := strings.SplitN(test.header, ": ", 2)
+			req.Header.Set(kv[0], kv[1])
+		}
+		if test.remote != "" {
+			req.RemoteAddr = test.remote
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if body := w.Body.String(); body != test.expected {
+			t.Errorf("%s %s: Expected %q, got %q", test.method, test.url, test.expected, body)
+		}
+	}
+}
+
+func TestNestedParams(t *testing.T) {
+	inner, err := New(subConfig(t, `{ "Rules" : [ { "Path" : "/users/{id}/{tab}", "Handler" : "tab" } ] }`), lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := New(subConfig(t, `{ "Rules" : [ { "Path" : "/{section}/", "Handler" : "inner" } ] }`),
+		func(string) (http.Handler, error) { return inner, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	outer.ServeHTTP(w, httptest.NewRequest("GET", "/users/7/posts", nil))
+	if body := w.Body.String(); body != "tab id=7 section=users tab=posts" {
+		t.Errorf("Bad nested params: %q", body)
+	}
+}
+
+func TestRouterErrors(t *testing.T) {
+	_, err := New(subConfig(t, `{
+        "Rules" : [
+            { "Path" : "users", "Handler" : "user" },
+            { "Path" : "/{rest...}/x", "PathRegex" : "/", "Handler" : "user" },
+            { "Path" : "/{rest...}/x", "Handler" : "user" },
+            { "Headers" : { "X-A" : "(" }, "Sources" : ["10.0.0.0/8", "nope"], "Handler" : "missing" },
+            { "Path" : "/" }
+        ]
+    }`), lookup)
+	errs, ok := err.(config.Errors)
+	if !ok {
+		t.Fatalf("Expected config.Errors, got %T: %v", err, err)
+	}
+
+	expected := []string{
+		"Rules.0.Path",
+		"Rules.1.PathRegex",
+		"Rules.2.Path",
+		"Rules.3.Headers.X-A",
+		"Rules.3.Sources.1",
+		"Rules.3.Handler",
+		"Rules.4.Handler",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %s", len(expected), len(errs), err)
+	}
+	for i, e := range errs {
+		var pe *config.PathError
+		if !errors.As(e, &pe) {
+			t.Fatalf("Error not located by path: %s", e)
+		}
+		if path := strings.Join(pe.Path, "."); path != expected[i] {
+			t.Errorf("Expected error at %s, got %s", expected[i], path)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// rule is a configured RuleConfig. Conditions not configured are nil.
+type rule struct {
+	hosts     []string
+	methods   []string
+	path      *pathPattern
+	pathRegex *regexp.Regexp
+	headers   map[string]*regexp.Regexp
+	query     map[string]*regexp.Regexp
+	cookies   map[string]*regexp.Regexp
+	sources   []*net.IPNet
+	priority  int
+	handler   http.Handler
+}
+
+// newRule configures a rule. Errors are located relative to the rule config.
+func newRule(cfg *RuleConfig, lookup func(string) (http.Handler, error)) (r *rule, err error) {
+	var errs config.Errors
+	r = &rule{priority: cfg.Priority}
+
+	for _, host := range cfg.Hosts {
+		r.hosts = append(r.hosts, strings.ToLower(host))
+	}
+	for _, method := range cfg.Methods {
+		r.methods = append(r.methods, strings.ToUpper(method))
+	}
+
+	if cfg.Path != "" && cfg.PathRegex != "" {
+		errs.Add(config.AtPath(errors.New("Only one of Path and PathRegex can be given"), "PathRegex"))
+	} else if cfg.Path != "" {
+		p, e := parsePathPattern(cfg.Path)
+		errs.Add(config.AtPath(e, "Path"))
+		r.path = p
+	} else if cfg.PathRegex != "" {
+		re, e := regexp.Compile(cfg.PathRegex)
+		errs.Add(config.AtPath(e, "PathRegex"))
+		r.pathRegex = re
+	}
+
+	var e error
+	if r.headers, e = compileValues(cfg.Headers, http.CanonicalHeaderKey); e != nil {
+		errs.Add(config.AtPath(e, "Headers"))
+	}
+	if r.query, e = compileValues(cfg.Query, nil); e != nil {
+		errs.Add(config.AtPath(e, "Query"))
+	}
+	if r.cookies, e = compileValues(cfg.Cookies, nil); e != nil {
+		errs.Add(config.AtPath(e, "Cookies"))
+	}
+
+	for i, source := range cfg.Sources {
+		n, e := parseSource(source)
+		if e != nil {
+			errs.Add(config.AtPath(e, "Sources", strconv.Itoa(i)))
+			continue
+		}
+		r.sources = append(r.sources, n)
+	}
+
+	if cfg.Handler == "" {
+		errs.Add(config.AtPath(errors.New("Missing Handler"), "Handler"))
+	} else {
+		r.handler, e = lookup(cfg.Handler)
+		if e != nil {
+			errs.Add(config.AtPath(fmt.Errorf("Handler(%s): %w", cfg.Handler, e), "Handler"))
+		}
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return r, nil
+}
+
+// compileValues compiles the regular expressions of a map of values - anchored to match
+// all of the value. Names are canonicalized by canon, if not nil.
+func compileValues(values map[string]string, canon func(string) string) (map[string]*regexp.Regexp, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	compiled := make(map[string]*regexp.Regexp, len(values))
+	for name, expr := range values {
+		if canon != nil {
+			name = canon(name)
+		}
+		var re *regexp.Regexp
+		if expr != "" {
+			var err error
+			re, err = regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, config.AtPath(err, name)
+			}
+		}
+		compiled[name] = re
+	}
+	return compiled, nil
+}
+
+// parseSource parses a CIDR or an IP address.
+func parseSource(source string) (*net.IPNet, error) {
+	if strings.Contains(source, "/") {
+		_, n, err := net.ParseCIDR(source)
+		return n, err
+	}
+	ip := net.ParseIP(source)
+	if ip == nil {
+		return nil, fmt.Errorf("Invalid IP address: %s", source)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// match tells whether the request matches the rule - returning any path parameters captured.
+// The path is matched last, so parameters are only captured for matching requests.
+func (r *rule) match(req *http.Request) (params map[string]string, ok bool) {
+	if r.hosts != nil && !matchHost(r.hosts, req.Host) {
+		return
+	}
+	if r.methods != nil && !contains(r.methods, req.Method) {
+		return
+	}
+	if r.sources != nil && !matchSource(r.sources, req.RemoteAddr) {
+		return
+	}
+	for name, re := range r.headers {
+		values, present := req.Header[name]
+		if !present || !matchAny(re, values) {
+			return
+		}
+	}
+	if r.query != nil {
+		query := req.URL.Query()
+		for name, re := range r.query {
+			values, present := query[name]
+			if !present || !matchAny(re, values) {
+				return
+			}
+		}
+	}
+	for name, re := range r.cookies {
+		c, err := req.Cookie(name)
+		if err != nil || (re != nil && !re.MatchString(c.Value)) {
+			return
+		}
+	}
+
+	switch {
+	case r.path != nil:
+		return r.path.match(req.URL.Path)
+	case r.pathRegex != nil:
+		m := r.pathRegex.FindStringSubmatch(req.URL.Path)
+		if m == nil {
+			return
+		}
+		for i, name := range r.pathRegex.SubexpNames() {
+			if name != "" {
+				if params == nil {
+					params = make(map[string]string)
+				}
+				params[name] = m[i]
+			}
+		}
+	}
+	return params, true
+}
+
+// matchAny tells whether any of the values matches re - or just whether there are values if re is nil.
+func matchAny(re *regexp.Regexp, values []string) bool {
+	if re == nil {
+		return true
+	}
+	for _, v := range values {
+		if re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost matches the host of a request - without any port - against host patterns.
+func matchHost(patterns []string, host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, p := range patterns {
+		switch {
+		case p == "*":
+			return true
+		case strings.HasPrefix(p, "*."):
+			if strings.HasSuffix(host, p[1:]) && len(host) > len(p)-1 {
+				return true
+			}
+		case p == host:
+			return true
+		}
+	}
+	return false
+}
+
+// matchSource matches the client IP of a request against networks.
+func matchSource(sources []*net.IPNet, remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range sources {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ---------------------------------------------------------------
+// Path patterns
+
+// pathPattern is a parsed path pattern. Parameter segments have a name.
+type pathPattern struct {
+	segments []segment
+	rest     string // name of a last "{name...}" segment capturing the rest of the path
+	subtree  bool   // the pattern ends in "/" matching everything below
+}
+
+type segment struct {
+	literal string
+	param   string
+}
+
+func parsePathPattern(pattern string) (*pathPattern, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return nil, errors.New(`Path must start with "/"`)
+	}
+	p := &pathPattern{}
+	trimmed := pattern[1:]
+	if strings.HasSuffix(trimmed, "/") || trimmed == "" {
+		p.subtree = true
+		trimmed = strings.TrimSuffix(trimmed, "/")
+	}
+	if trimmed == "" {
+		return p, nil
+	}
+	parts := strings.Split(trimmed, "/")
+	for i, part := range parts {
+		if !strings.HasPrefix(part, "{") || !strings.HasSuffix(part, "}") {
+			if strings.ContainsAny(part, "{}") {
+				return nil, fmt.Errorf("Invalid path segment: %s", part)
+			}
+			p.segments = append(p.segments, segment{literal: part})
+			continue
+		}
+		name := part[1 : len(part)-1]
+		if strings.HasSuffix(name, "...") {
+			if i != len(parts)-1 || p.subtree {
+				return nil, fmt.Errorf("%s must be the last path segment", part)
+			}
+			name = strings.TrimSuffix(name, "...")
+			if name == "" {
+				return nil, errors.New("Path parameter without name")
+			}
+			p.rest = name
+			continue
+		}
+		if name == "" {
+			return nil, errors.New("Path parameter without name")
+		}
+		p.segments = append(p.segments, segment{param: name})
+	}
+	return p, nil
+}
+
+// match matches a path - returning the parameters captured.
+func (p *pathPattern) match(path string) (params map[string]string, ok bool) {
+	if !strings.HasPrefix(path, "/") {
+		return
+	}
+	// "/a/b/" has the parts "a", "b" and "".
+	parts := strings.Split(path[1:], "/")
+	if len(parts) < len(p.segments) {
+		return
+	}
+	for i, seg := range p.segments {
+		if seg.param == "" {
+			if parts[i] != seg.literal {
+				return nil, false
+			}
+			continue
+		}
+		if parts[i] == "" {
+			return nil, false
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[seg.param] = parts[i]
+	}
+	rest := parts[len(p.segments):]
+	switch {
+	case p.rest != "":
+		if len(rest) == 0 {
+			return nil, false
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[p.rest] = strings.Join(rest, "/")
+		return params, true
+	case p.subtree:
+		return params, len(rest) != 0
+	default:
+		return params, len(rest) == 0
+	}
+}
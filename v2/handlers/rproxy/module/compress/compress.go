@@ -0,0 +1,42 @@
+package compress
+
+import (
+	"net/http"
+
+	"github.com/One-com/gone/jconf"
+
+	compression "github.com/One-com/ozone/v2/handlers/compress"
+	"github.com/One-com/ozone/v2/rproxymod"
+)
+
+//       "Modules": {
+//         "compress": {
+//           "Type": "compress",
+//           "Config": {
+//             "Encodings": ["br", "gzip"],
+//             "MinSize": 1024
+//           }
+//         }
+// }
+
+// Config of the module - compressing uncompressed backend responses accepted compressed by the client.
+type Config = compression.Config
+
+type Module struct {
+	rproxymod.BaseModule
+	compressor *compression.Compressor
+}
+
+func InitModule(cfg jconf.SubConfig) (rpmod rproxymod.ProxyModule, err error) {
+	c, err := compression.New(cfg)
+	if err != nil {
+		return
+	}
+	rpmod = &Module{compressor: c}
+	return
+}
+
+func (mod *Module) ModifyResponse(reqCtx *rproxymod.RequestContext, inReq *http.Request, resp *http.Response) error {
+	mod.compressor.CompressResponse(inReq, resp)
+	return nil
+}
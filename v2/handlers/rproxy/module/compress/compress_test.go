@@ -0,0 +1,74 @@
+package compress_test
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/handlers/rproxy"
+)
+
+var proxyConfig = `{
+    "ModuleDir" : %q,
+    "ModuleOrder" : [ "forward", "compress" ],
+    "Modules" : {
+        "forward" : {
+            "Type" : "forward_map_director",
+            "Config" : { "Forward" : { "" : %q } }
+        },
+        "compress" : {
+            "Type" : "compress",
+            "Config" : { "Encodings" : [ "gzip" ], "MinSize" : 10 }
+        }
+    }
+}`
+
+// TestModule verifies that a proxy with the module compresses backend responses.
+func TestModule(t *testing.T) {
+	large := strings.Repeat("backend data ", 100)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, large)
+	}))
+	defer backend.Close()
+
+	var cfg *jconf.OptionalSubConfig
+	if err := json.Unmarshal([]byte(fmt.Sprintf(proxyConfig, t.TempDir(), backend.URL)), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	proxy, err := rproxy.NewProxy("test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxy.Deinit()
+
+	for _, accept := range []string{"gzip", ""} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", accept)
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+
+		if w.Code != 200 || w.Header().Get("Content-Encoding") != accept {
+			t.Fatalf("Accept-Encoding %q: Expected 200 and Content-Encoding %q, got %d %v", accept, accept, w.Code, w.Header())
+		}
+		if w.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("Accept-Encoding %q: Bad Vary: %v", accept, w.Header())
+		}
+		var body io.Reader = w.Body
+		if accept == "gzip" {
+			if body, err = gzip.NewReader(w.Body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if data, err := io.ReadAll(body); err != nil || string(data) != large {
+			t.Errorf("Accept-Encoding %q: Bad body: %q %v", accept, data, err)
+		}
+	}
+}
@@ -7,10 +7,15 @@ import (
 	"plugin"
 	"sync"
 
+	werr "github.com/pkg/errors"
+
 	"github.com/One-com/gone/jconf"
 	"github.com/One-com/ozone/v2/rproxymod"
 
+	"github.com/One-com/ozone/v2/config"
+
 	"github.com/One-com/ozone/v2/handlers/rproxy/module/backendsettings"
+	"github.com/One-com/ozone/v2/handlers/rproxy/module/compress"
 	"github.com/One-com/ozone/v2/handlers/rproxy/module/forward_map_director"
 	"github.com/One-com/ozone/v2/handlers/rproxy/module/host_suffix_director"
 	"github.com/One-com/ozone/v2/handlers/rproxy/module/proxypass"
@@ -19,6 +24,7 @@ import (
 
 var moduleRegistryMu sync.Mutex
 var moduleRegistry = map[string]func(jconf.SubConfig) (rproxymod.ProxyModule, error){}
+var moduleSchemas = map[string]interface{}{}
 
 func init() {
 	preloadBuiltinModules()
@@ -32,6 +38,14 @@ func preloadBuiltinModules() {
 	moduleRegistry["set_header"] = set_header.InitModule
 	moduleRegistry["proxypass"] = proxypass.InitModule
 	moduleRegistry["backendsettings"] = backendsettings.InitModule
+	moduleRegistry["compress"] = compress.InitModule
+
+	moduleSchemas["forward_map_director"] = &forward_map_director.Config{}
+	moduleSchemas["host_suffix_director"] = &host_suffix_director.Config{}
+	moduleSchemas["set_header"] = &set_header.Config{}
+	moduleSchemas["proxypass"] = &proxypass.Config{}
+	moduleSchemas["backendsettings"] = &backendsettings.Config{}
+	moduleSchemas["compress"] = &compress.Config{}
 }
 
 // RegisterReverseProxyModule registers an initalization function for a reverse proxy
@@ -44,14 +58,47 @@ func RegisterReverseProxyModule(typename string, initfunc func(jconf.SubConfig)
 	moduleRegistry[typename] = initfunc
 }
 
+// RegisterReverseProxyModuleSchema provides the config of a module type for generating a
+// JSON Schema of the config. cfg is typically a pointer to the struct the module config is
+// parsed into - or a config.Schema. Modules without a schema can have any config.
+func RegisterReverseProxyModuleSchema(typename string, cfg interface{}) {
+	moduleRegistryMu.Lock()
+	defer moduleRegistryMu.Unlock()
+	moduleSchemas[typename] = cfg
+}
+
+// ConfigSchema returns a JSON Schema for the config of the "ReverseProxy" handler type
+// including the config of all module types with a registered schema.
+func ConfigSchema() config.Schema {
+	s := config.SchemaOf(&ProxyConfig{})
+
+	moduleRegistryMu.Lock()
+	modules := make(map[string]config.Schema)
+	for name, cfg := range moduleSchemas {
+		modules[name] = config.SchemaOf(cfg)
+	}
+	moduleRegistryMu.Unlock()
+	s.Property("Modules").Elements().SetTypedConfig("Config", modules)
+
+	vt := config.SchemaOf(&VirtualTransportConfig{})
+	vt.SetTypedConfig("Config", map[string]config.Schema{"RoundRobin": config.SchemaOf(&RRUpstreamConfig{})})
+	s.Property("Transport").SetTypedConfig("Config", map[string]config.Schema{"Virtual": vt})
+	return s
+}
+
+// proxyModuleFor configures a module. Errors are located relative to the module config.
 func proxyModuleFor(cfg *ModuleConfig) (mod rproxymod.ProxyModule, err error) {
 	moduleRegistryMu.Lock()
 	defer moduleRegistryMu.Unlock()
 
 	if initfunc, ok := moduleRegistry[cfg.Type]; ok {
-		return initfunc(cfg.Config)
+		mod, err = initfunc(cfg.Config)
+		if err != nil {
+			err = config.AtPath(werr.Wrapf(err, "Configuring module %s", cfg.Type), "Config")
+		}
+		return
 	}
-	err = fmt.Errorf("No such module type: %s", cfg.Type)
+	err = config.AtPath(fmt.Errorf("No such module type: %s", cfg.Type), "Type")
 	return
 }
 
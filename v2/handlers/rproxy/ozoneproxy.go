@@ -9,11 +9,10 @@ import (
 	"crypto/x509"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
-	werr "github.com/pkg/errors"
-
 	"github.com/One-com/gone/jconf"
 	"github.com/One-com/gone/log"
 
@@ -93,7 +92,8 @@ type OzoneProxy struct {
 	service func(context.Context) error
 }
 
-// NewProxy instantiates a new reverse proxy handler based on the provided JSON config
+// NewProxy instantiates a new reverse proxy handler based on the provided JSON config.
+// Errors are located (as config.PathError) relative to the proxy config.
 func NewProxy(name string, js jconf.SubConfig) (proxy *OzoneProxy, err error) {
 
 	var cfg *ProxyConfig
@@ -109,6 +109,7 @@ func NewProxy(name string, js jconf.SubConfig) (proxy *OzoneProxy, err error) {
 	err = scanPluginDir(cfg.ModuleDir)
 	if err != nil {
 		log.ERROR("Plugin scan failed", "err", err)
+		err = config.AtPath(err, "ModuleDir")
 		return
 	}
 
@@ -154,7 +155,7 @@ func NewProxy(name string, js jconf.SubConfig) (proxy *OzoneProxy, err error) {
 		if tCfg.TLS != nil {
 			tlsCfg, err = tlsconf.GetTLSClientConfig(tCfg.TLS)
 			if err != nil {
-				return nil, err
+				return nil, config.AtPath(err, "Transport", "TLS")
 			}
 		}
 	} else {
@@ -193,39 +194,51 @@ func NewProxy(name string, js jconf.SubConfig) (proxy *OzoneProxy, err error) {
 	case "Virtual":
 		transport, service, err = initVirtualTransport(defaultTransport, cfg.Transport.Config)
 		if err != nil {
-			return nil, err
+			return nil, config.AtPath(err, "Transport", "Config")
 		}
 	case "Default":
 		transport = defaultTransport
 	default:
-		fmt.Printf("Unknown transport: %s", transportType)
+		err = config.AtPath(fmt.Errorf("Unknown transport: %s", transportType), "Transport", "Type")
+		return
 	}
 
 	// TODO read timeouts from the configuration object
 	moduleCount := len(cfg.ModuleOrder)
 	modules := make([]rproxymod.ProxyModule, moduleCount)
 
+	// Configure all modules to report all errors at once.
+	var errs config.Errors
 	//var mod_names string
 	for i, modName := range cfg.ModuleOrder {
 		log.DEBUG(fmt.Sprintf("Adding proxy module \"%s\"", modName))
 		var mod rproxymod.ProxyModule
 		modCfg, ok := cfg.Modules[modName]
 		if !ok {
-			err = fmt.Errorf("No such module: %s", modName)
-			log.CRIT(err.Error())
-			err = config.WrapError(err)
-			return
+			e := fmt.Errorf("No such module: %s", modName)
+			log.CRIT(e.Error())
+			errs.Add(config.AtPath(e, "ModuleOrder", strconv.Itoa(i)))
+			continue
 		}
-		mod, err = proxyModuleFor(&modCfg)
-		if err != nil {
-			err = werr.Wrapf(err, "Configuring module %s", modCfg.Type)
-			err = config.WrapError(err)
-			return
+		mod, e := proxyModuleFor(&modCfg)
+		if e != nil {
+			errs.Add(config.AtPath(e, "Modules", modName))
+			continue
 		}
 		modules[i] = mod
 		//mod_names += modName + ","
 		log.DEBUG(fmt.Sprintf("Successfully added proxy module \"%s\" (%s)", modName, modCfg.Type))
 	}
+	if len(errs) != 0 {
+		// Let the modules which made it clean up.
+		for _, mod := range modules {
+			if mod != nil {
+				mod.Deinit()
+			}
+		}
+		err = errs
+		return
+	}
 
 	proxy = &OzoneProxy{
 		reverseProxy: reverseProxy{
@@ -242,6 +255,22 @@ func NewProxy(name string, js jconf.SubConfig) (proxy *OzoneProxy, err error) {
 	return proxy, nil
 }
 
+// ConfigFiles returns the files read by a proxy configured from js - the certificates and CA files
+// of its transport.
+func ConfigFiles(js jconf.SubConfig) (files []string) {
+	var cfg *ProxyConfig
+	if js.ParseInto(&cfg) != nil || cfg == nil || cfg.Transport == nil || cfg.Transport.TLS == nil {
+		return
+	}
+	for _, ca := range cfg.Transport.TLS.RootCAs {
+		files = append(files, ca)
+	}
+	for _, cert := range cfg.Transport.TLS.Certificates {
+		files = append(files, cert.CrtPEMFile, cert.KeyPEMFile)
+	}
+	return
+}
+
 // An object representing any autonomous activity the proxy handler might
 // perform - like health check on backends.
 type proxyservice struct {
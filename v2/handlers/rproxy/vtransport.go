@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
 	"time"
 
@@ -15,6 +16,7 @@ import (
 	"github.com/One-com/gone/jconf"
 	"github.com/One-com/gone/log"
 
+	"github.com/One-com/ozone/v2/config"
 	"github.com/One-com/ozone/v2/rproxymod"
 )
 
@@ -88,7 +90,7 @@ func initVirtualTransport(wrapped *http.Transport, js jconf.SubConfig) (vt *vtra
 	}
 
 	if cfg.Type != "RoundRobin" {
-		err = fmt.Errorf("Unknown upstream type: %s", cfg.Type)
+		err = config.AtPath(fmt.Errorf("Unknown upstream type: %s", cfg.Type), "Type")
 		return
 	}
 
@@ -98,6 +100,7 @@ func initVirtualTransport(wrapped *http.Transport, js jconf.SubConfig) (vt *vtra
 	if cfg.Config != nil {
 		err = cfg.Config.ParseInto(&rrcfg)
 		if err != nil {
+			err = config.AtPath(err, "Config")
 			return
 		}
 	}
@@ -113,6 +116,7 @@ func initVirtualTransport(wrapped *http.Transport, js jconf.SubConfig) (vt *vtra
 			// parse health check URI once and for all
 			healthuri, err = url.ParseRequestURI(rrcfg.HealthCheck.URIPath)
 			if err != nil {
+				err = config.AtPath(err, "Config", "HealthCheck", "URIPath")
 				return
 			}
 		}
@@ -124,10 +128,10 @@ func initVirtualTransport(wrapped *http.Transport, js jconf.SubConfig) (vt *vtra
 	upstreams := make(map[string]vtransport.VirtualUpstream)
 	for k, v := range cfg.Upstreams {
 		var urls = make([]*url.URL, 0)
-		for _, urlStr := range v {
+		for i, urlStr := range v {
 			url, e := url.Parse(urlStr)
 			if e != nil {
-				err = e
+				err = config.AtPath(e, "Upstreams", k, strconv.Itoa(i))
 				return
 
 			}
@@ -198,6 +202,7 @@ func initVirtualTransport(wrapped *http.Transport, js jconf.SubConfig) (vt *vtra
 		upstreams[k], err = rr.NewRoundRobinUpstream(RROptions...)
 
 		if err != nil {
+			err = config.AtPath(err, "Upstreams", k)
 			return
 		}
 	}
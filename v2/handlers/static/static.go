@@ -0,0 +1,330 @@
+// Package static implements the "Static" handler type serving files from a directory.
+//
+// Files are served with ETag and Last-Modified headers, answering conditional and Range requests
+// like http.ServeContent. Precompressed sidecar files ("style.css.br", "style.css.gz") are served
+// instead of the file itself to clients accepting their encoding.
+package static
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// Config defines JSON for configuring the "Static" handler type.
+//
+// Files are served from Root - after removing StripPrefix from the request path.
+// Directories are served by their first existing Index file (default "index.html") - or listed
+// if Listing is enabled.
+// Precompressed lists the encodings ("br", "gzip") of sidecar files to look for - in order of preference.
+// CacheControl sets the Cache-Control header of files by the first rule whose Pattern (see path.Match)
+// matches the path - or the file name for patterns without "/".
+// Fallback is a file (relative to Root) served for paths not found, like the index.html of a single page app.
+type Config struct {
+	Root          string
+	StripPrefix   string             `json:",omitempty"`
+	Index         []string           `json:",omitempty"`
+	Listing       bool               `json:",omitempty"`
+	Precompressed []string           `json:",omitempty"`
+	CacheControl  []CacheControlRule `json:",omitempty"`
+	Fallback      string             `json:",omitempty"`
+}
+
+// CacheControlRule sets the Cache-Control header of files matching Pattern.
+type CacheControlRule struct {
+	Pattern string
+	Value   string
+}
+
+// encodingExts are the file extensions of sidecar files by encoding.
+var encodingExts = map[string]string{
+	"br":   ".br",
+	"gzip": ".gz",
+}
+
+// Handler serves files of a directory.
+type Handler struct {
+	root          string
+	stripPrefix   string
+	index         []string
+	listing       bool
+	precompressed []string
+	cacheControl  []CacheControlRule
+	fallback      string // clean URL path of the fallback file
+}
+
+// New makes a Handler from its JSON config.
+// Errors are located (as config.PathError) relative to the handler config.
+func New(js jconf.SubConfig) (handler *Handler, err error) {
+	var cfg *Config
+	err = js.ParseInto(&cfg)
+	if err != nil {
+		return
+	}
+	if cfg == nil {
+		err = errors.New("Missing Static config")
+		return
+	}
+
+	var errs config.Errors
+	if cfg.Root == "" {
+		errs.Add(config.AtPath(errors.New("Missing Root"), "Root"))
+	} else if fi, e := os.Stat(cfg.Root); e != nil {
+		errs.Add(config.AtPath(e, "Root"))
+	} else if !fi.IsDir() {
+		errs.Add(config.AtPath(fmt.Errorf("Not a directory: %s", cfg.Root), "Root"))
+	}
+
+	handler = &Handler{
+		root:          cfg.Root,
+		stripPrefix:   cfg.StripPrefix,
+		index:         cfg.Index,
+		listing:       cfg.Listing,
+		precompressed: cfg.Precompressed,
+		cacheControl:  cfg.CacheControl,
+	}
+	if handler.index == nil {
+		handler.index = []string{"index.html"}
+	}
+	for i, enc := range cfg.Precompressed {
+		if _, ok := encodingExts[enc]; !ok {
+			errs.Add(config.AtPath(fmt.Errorf("Unknown encoding: %s", enc), "Precompressed", strconv.Itoa(i)))
+		}
+	}
+	for i, rule := range cfg.CacheControl {
+		if _, e := path.Match(rule.Pattern, ""); e != nil {
+			errs.Add(config.AtPath(e, "CacheControl", strconv.Itoa(i), "Pattern"))
+		}
+	}
+	if cfg.Fallback != "" && len(errs) == 0 {
+		handler.fallback = path.Clean("/" + cfg.Fallback)
+		if fi, e := os.Stat(handler.file(handler.fallback)); e != nil {
+			errs.Add(config.AtPath(e, "Fallback"))
+		} else if fi.IsDir() {
+			errs.Add(config.AtPath(fmt.Errorf("Not a file: %s", cfg.Fallback), "Fallback"))
+		}
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return
+}
+
+// file returns the name of the file of a clean URL path.
+func (h *Handler) file(p string) string {
+	return filepath.Join(h.root, filepath.FromSlash(p))
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	upath := r.URL.Path
+	if h.stripPrefix != "" {
+		if !strings.HasPrefix(upath, h.stripPrefix) {
+			http.NotFound(w, r)
+			return
+		}
+		upath = upath[len(h.stripPrefix):]
+	}
+	// Cleaning the rooted path keeps it within the root.
+	p := path.Clean("/" + upath)
+
+	fi, err := os.Stat(h.file(p))
+	if err != nil {
+		h.notFound(w, r, err)
+		return
+	}
+
+	if fi.IsDir() {
+		// Relative links of index files and listings need the trailing "/".
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			redirect(w, r, path.Base(r.URL.Path)+"/")
+			return
+		}
+		for _, index := range h.index {
+			ip := path.Join(p, index)
+			if ifi, e := os.Stat(h.file(ip)); e == nil && !ifi.IsDir() {
+				h.serveFile(w, r, ip, ifi)
+				return
+			}
+		}
+		if h.listing {
+			h.list(w, r, p)
+			return
+		}
+		h.notFound(w, r, os.ErrNotExist)
+		return
+	}
+
+	// Files are served at their own path - not with a trailing "/".
+	if strings.HasSuffix(r.URL.Path, "/") && p != "/" {
+		redirect(w, r, "../"+path.Base(p))
+		return
+	}
+	h.serveFile(w, r, p, fi)
+}
+
+func redirect(w http.ResponseWriter, r *http.Request, target string) {
+	if q := r.URL.RawQuery; q != "" {
+		target += "?" + q
+	}
+	w.Header().Set("Location", target)
+	w.WriteHeader(http.StatusMovedPermanently)
+}
+
+// notFound serves the fallback file for paths not found - if any.
+func (h *Handler) notFound(w http.ResponseWriter, r *http.Request, err error) {
+	if os.IsNotExist(err) && h.fallback != "" {
+		if fi, e := os.Stat(h.file(h.fallback)); e == nil && !fi.IsDir() {
+			h.serveFile(w, r, h.fallback, fi)
+			return
+		}
+	}
+	if os.IsPermission(err) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// serveFile serves the file of the clean URL path p - or the best precompressed sidecar accepted.
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, p string, fi os.FileInfo) {
+	name := h.file(p)
+	hdr := w.Header()
+
+	ctype := mime.TypeByExtension(path.Ext(p))
+	encoding := ""
+	if len(h.precompressed) != 0 {
+		hdr.Add("Vary", "Accept-Encoding")
+		accepted := acceptedEncodings(r.Header.Get("Accept-Encoding"))
+		for _, enc := range h.precompressed {
+			if !accepted[enc] {
+				continue
+			}
+			if sfi, err := os.Stat(name + encodingExts[enc]); err == nil && !sfi.IsDir() {
+				name, fi, encoding = name+encodingExts[enc], sfi, enc
+				break
+			}
+		}
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		h.notFound(w, r, err)
+		return
+	}
+	defer f.Close()
+
+	if encoding != "" {
+		hdr.Set("Content-Encoding", encoding)
+		if ctype == "" {
+			// Sniffing compressed content would be wrong.
+			ctype = "application/octet-stream"
+		}
+	}
+	if ctype != "" {
+		hdr.Set("Content-Type", ctype)
+	}
+	hdr.Set("ETag", etag(fi, encoding))
+	if cc := h.cacheControlOf(p); cc != "" {
+		hdr.Set("Cache-Control", cc)
+	}
+	http.ServeContent(w, r, p, fi.ModTime(), f)
+}
+
+// etag identifies the content of a file by its size and modification time - and encoding.
+func etag(fi os.FileInfo, encoding string) string {
+	tag := strconv.FormatInt(fi.Size(), 36) + "-" + strconv.FormatInt(fi.ModTime().UnixNano(), 36)
+	if encoding != "" {
+		tag += "-" + encoding
+	}
+	return `"` + tag + `"`
+}
+
+func (h *Handler) cacheControlOf(p string) string {
+	for _, rule := range h.cacheControl {
+		name := p
+		if !strings.Contains(rule.Pattern, "/") {
+			name = path.Base(p)
+		}
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+// acceptedEncodings returns the encodings of an Accept-Encoding header not refused by "q=0".
+func acceptedEncodings(header string) map[string]bool {
+	accepted := make(map[string]bool)
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		enc := strings.ToLower(strings.TrimSpace(fields[0]))
+		if enc == "" {
+			continue
+		}
+		ok := true
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				ok = err == nil && q > 0
+			}
+		}
+		accepted[enc] = ok
+	}
+	return accepted
+}
+
+// list writes an HTML listing of the directory of the clean URL path p.
+func (h *Handler) list(w http.ResponseWriter, r *http.Request, p string) {
+	f, err := os.Open(h.file(p))
+	if err != nil {
+		h.notFound(w, r, err)
+		return
+	}
+	entries, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() {
+			name += "/"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, "<!doctype html>\n<pre>\n")
+	for _, name := range names {
+		link := url.URL{Path: name}
+		fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", html.EscapeString(link.String()), html.EscapeString(name))
+	}
+	io.WriteString(w, "</pre>\n")
+}
@@ -0,0 +1,183 @@
+package static
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+func newHandler(t *testing.T, js string) (*Handler, error) {
+	t.Helper()
+	var cfg *jconf.OptionalSubConfig
+	if err := json.Unmarshal([]byte(js), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	return New(cfg)
+}
+
+// makeTree makes files with their name as content - "dir/" making a directory.
+func makeTree(t *testing.T, names ...string) string {
+	t.Helper()
+	root := t.TempDir()
+	for _, name := range names {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if strings.HasSuffix(name, "/") {
+			if err := os.MkdirAll(p, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func serve(h http.Handler, method, target string, header ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestStatic(t *testing.T) {
+	root := makeTree(t, "index.html", "app.js", "app.js.br", "app.js.gz", "css/site.css", "docs/a.txt", "docs/b/", "empty/")
+	h, err := newHandler(t, `{
+        "Root" : "`+root+`",
+        "StripPrefix" : "/assets",
+        "Precompressed" : ["br", "gzip"],
+        "CacheControl" : [
+            { "Pattern" : "*.js", "Value" : "max-age=3600" },
+            { "Pattern" : "/css/*", "Value" : "no-cache" }
+        ]
+    }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   []string
+		code     int
+		body     string
+		expected map[string]string // response headers
+	}{
+		{"index", "GET", "/assets/", nil, 200, "index.html", map[string]string{"Content-Type": "text/html; charset=utf-8"}},
+		{"file", "GET", "/assets/css/site.css", nil, 200, "css/site.css", map[string]string{"Cache-Control": "no-cache", "Content-Encoding": ""}},
+		{"brotli", "GET", "/assets/app.js", []string{"Accept-Encoding", "gzip, br"}, 200, "app.js.br",
+			map[string]string{"Content-Encoding": "br", "Content-Type": "text/javascript; charset=utf-8", "Cache-Control": "max-age=3600", "Vary": "Accept-Encoding"}},
+		{"gzip", "GET", "/assets/app.js", []string{"Accept-Encoding", "gzip, br;q=0"}, 200, "app.js.gz", map[string]string{"Content-Encoding": "gzip"}},
+		{"identity", "GET", "/assets/app.js", nil, 200, "app.js", map[string]string{"Content-Encoding": ""}},
+		{"range", "GET", "/assets/app.js", []string{"Range", "bytes=1-3"}, 206, "pp.", nil},
+		{"dir redirect", "GET", "/assets/docs?x=1", nil, 301, "", map[string]string{"Location": "docs/?x=1"}},
+		{"file redirect", "GET", "/assets/app.js/", nil, 301, "", map[string]string{"Location": "../app.js"}},
+		{"no listing", "GET", "/assets/docs/", nil, 404, "404 page not found\n", nil},
+		{"missing", "GET", "/assets/nope.txt", nil, 404, "404 page not found\n", nil},
+		{"traversal", "GET", "/assets/../../etc/passwd", nil, 404, "404 page not found\n", nil},
+		{"prefix", "GET", "/other/app.js", nil, 404, "404 page not found\n", nil},
+		{"method", "POST", "/assets/app.js", nil, 405, "Method Not Allowed\n", map[string]string{"Allow": "GET, HEAD"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := serve(h, test.method, test.target, test.header...)
+			if w.Code != test.code {
+				t.Errorf("Expected status %d, got %d", test.code, w.Code)
+			}
+			if test.body != "" && w.Body.String() != test.body {
+				t.Errorf("Expected body %q, got %q", test.body, w.Body.String())
+			}
+			for k, v := range test.expected {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("Expected %s %q, got %q", k, v, got)
+				}
+			}
+		})
+	}
+}
+
+func TestConditional(t *testing.T) {
+	root := makeTree(t, "a.txt")
+	h, err := newHandler(t, `{ "Root" : "`+root+`" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, "GET", "/a.txt")
+	etag, modified := w.Header().Get("ETag"), w.Header().Get("Last-Modified")
+	if etag == "" || modified == "" {
+		t.Fatalf("Missing validators: %v", w.Header())
+	}
+	if w = serve(h, "GET", "/a.txt", "If-None-Match", etag); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for matching ETag, got %d", w.Code)
+	}
+	if w = serve(h, "GET", "/a.txt", "If-Modified-Since", modified); w.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for not modified, got %d", w.Code)
+	}
+}
+
+func TestListingAndFallback(t *testing.T) {
+	root := makeTree(t, "index.html", "docs/a&b.txt", "docs/sub/")
+	h, err := newHandler(t, `{ "Root" : "`+root+`", "Listing" : true, "Fallback" : "index.html" }`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, "GET", "/docs/")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `<a href="a&amp;b.txt">a&amp;b.txt</a>`) ||
+		!strings.Contains(w.Body.String(), `<a href="sub/">sub/</a>`) {
+		t.Errorf("Bad listing: %d %s", w.Code, w.Body.String())
+	}
+	w = serve(h, "GET", "/app/route/42")
+	if w.Code != 200 || w.Body.String() != "index.html" {
+		t.Errorf("Expected the fallback, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	root := makeTree(t, "a.txt")
+	_, err := newHandler(t, `{
+        "Root" : "`+root+`",
+        "Precompressed" : ["gzip", "zip"],
+        "CacheControl" : [ { "Pattern" : "[", "Value" : "no-cache" } ]
+    }`)
+	errs, ok := err.(config.Errors)
+	if !ok {
+		t.Fatalf("Expected config.Errors, got %T: %v", err, err)
+	}
+	expected := []string{"Precompressed.1", "CacheControl.0.Pattern"}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %s", len(expected), len(errs), err)
+	}
+	for i, e := range errs {
+		var pe *config.PathError
+		if !errors.As(e, &pe) {
+			t.Fatalf("Error not located by path: %s", e)
+		}
+		if path := strings.Join(pe.Path, "."); path != expected[i] {
+			t.Errorf("Expected error at %s, got %s", expected[i], path)
+		}
+	}
+
+	if _, err = newHandler(t, `{ "Root" : "`+filepath.Join(root, "a.txt")+`" }`); err == nil {
+		t.Error("Expected error for a Root not being a directory")
+	}
+	if _, err = newHandler(t, `{ "Root" : "`+root+`", "Fallback" : "nope.html" }`); err == nil {
+		t.Error("Expected error for a missing Fallback")
+	}
+}
@@ -17,14 +17,27 @@ import (
 	"github.com/One-com/gone/netutil"
 
 	"github.com/One-com/ozone/v2/config"
+	"github.com/One-com/ozone/v2/proxyproto"
 
 	"github.com/One-com/gone/netutil/reaper"
+
+	"golang.org/x/net/http2"
 )
 
 
 func reaperConnStateCallback(to time.Duration) func(net.Conn, http.ConnState) {
 
 	return func (conn net.Conn, state http.ConnState) {
+		// Get to the connection of the listener under any TLS and minimum rate enforcement.
+		tc, isTLS := conn.(*tls.Conn)
+		if isTLS {
+			conn = tc.NetConn()
+		}
+		rc, rated := conn.(*rateConn)
+		if rated {
+			conn = rc.Conn
+		}
+
 		switch state {
 		case http.StateNew:
 			// Put a timebomb on the connection requiring it to
@@ -43,26 +56,95 @@ func reaperConnStateCallback(to time.Duration) func(net.Conn, http.ConnState) {
 		case http.StateIdle, http.StateClosed, http.StateHijacked:
 			reaper.IOActivityTimeout(conn, false)
 		}
+		if rated {
+			switch state {
+			case http.StateActive:
+				// HTTP/2 connections read frames while waiting for streams, so their rate tells nothing.
+				if isTLS && tc.ConnectionState().NegotiatedProtocol == http2.NextProtoTLS {
+					rc.stop()
+				} else {
+					rc.active()
+				}
+			case http.StateIdle:
+				rc.idle()
+			case http.StateHijacked:
+				rc.stop()
+			}
+		}
 	}
 }
 
 // newHTTPServer creates a deamon.Server complying HTTP server from config with the given handler
 func newHTTPServer(name string, cfg config.HTTPServerConfig, snis *tlsPluginRegistry, handler http.Handler) (srv *nshttp.Server, err error) {
 
-	var listeners daemon.ListenerGroup
+	var listeners listenerGroup
+	var tlsConfigs []*tls.Config
+	var errs config.Errors
+
+	for lname, lcfg := range cfg.Listeners {
+		network := lcfg.Network
+		if network == "" {
+			network = "tcp"
+		}
+
+		var addr string
+		var sock *unixSocket
+		var tcp *tcpSocket
+		switch network {
+		case "tcp", "tcp4", "tcp6":
+			if lcfg.Path != "" || lcfg.Mode != "" || lcfg.Owner != "" {
+				collectError(&errs, fmt.Errorf("TCP listener has no Path, Mode or Owner"), "Listeners", lname)
+				continue
+			}
+			var e error
+			tcp, e = newTCPSocket(lcfg)
+			if e != nil {
+				collectError(&errs, e, "Listeners", lname)
+				continue
+			}
+			addr = net.JoinHostPort(lcfg.Address, strconv.Itoa(lcfg.Port))
+			if lcfg.Port == 0 {
+				// Keep the port chosen by the OS across reloads by inheriting the listening socket.
+				if bound, ok := listenerAddrs.lookup(name, lname).(*net.TCPAddr); ok {
+					addr = net.JoinHostPort(lcfg.Address, strconv.Itoa(bound.Port))
+				}
+			}
 
-	for _, lcfg := range cfg.Listeners { // ignore name
-		addr := lcfg.Address + ":" + strconv.Itoa(lcfg.Port)
+			// Listening is left to the daemon, but catch bad addresses early.
+			if _, e := net.ResolveTCPAddr(network, addr); e != nil {
+				collectError(&errs, e, "Listeners", lname)
+				continue
+			}
+		case "unix":
+			if lcfg.ReusePort || lcfg.Acceptors != 0 || lcfg.Backlog != 0 || lcfg.ReadBuffer != 0 || lcfg.WriteBuffer != 0 ||
+				lcfg.KeepAlive.Duration != 0 || lcfg.NoDelay != nil || lcfg.DeferAccept.Duration != 0 || lcfg.FastOpen != 0 {
+				collectError(&errs, fmt.Errorf("UNIX socket listener has no TCP socket options"), "Listeners", lname)
+				continue
+			}
+			var e error
+			sock, e = newUnixSocket(lcfg)
+			if e != nil {
+				collectError(&errs, e, "Listeners", lname)
+				continue
+			}
+			addr = lcfg.Path
+		default:
+			collectError(&errs, fmt.Errorf("Unknown network: %s", lcfg.Network), "Listeners", lname, "Network")
+			continue
+		}
 
 		var tlsCfg *tls.Config
 		if lcfg.TLS != nil {
-			tlsCfg, err = getTLSServerConfigWithPlugin(lcfg.TLS, snis)
-			if err != nil {
-				return nil, err
+			var e error
+			tlsCfg, e = getTLSServerConfigWithPlugin(lcfg.TLS, snis)
+			if e != nil {
+				collectError(&errs, e, "Listeners", lname, "TLS")
+				continue
 			}
 			if tlsCfg == nil {
 				log.ERROR("TLS requested, but not configured")
 			} else {
+				tlsConfigs = append(tlsConfigs, tlsCfg)
 				log.DEBUG("TLS Config", "ciphers", log.Lazy(func() interface{} { return fmt.Sprint(tlsCfg.CipherSuites) }))
 				if tlsCfg.GetCertificate == nil && len(tlsCfg.Certificates) == 0 {
 					log.WARN("No Server certificates and no SNI callback enabled")
@@ -70,28 +152,111 @@ func newHTTPServer(name string, cfg config.HTTPServerConfig, snis *tlsPluginRegi
 			}
 		}
 
-		listener := daemon.ListenerSpec{
+		if lcfg.MaxConnections < 0 {
+			collectError(&errs, fmt.Errorf("MaxConnections must not be negative"), "Listeners", lname, "MaxConnections")
+			continue
+		}
+		if lcfg.MaxConnectionsPerIP < 0 {
+			collectError(&errs, fmt.Errorf("MaxConnectionsPerIP must not be negative"), "Listeners", lname, "MaxConnectionsPerIP")
+			continue
+		}
+		maxConns, maxConnsPerIP := lcfg.MaxConnections, lcfg.MaxConnectionsPerIP
+		limited := maxConns != 0 || maxConnsPerIP != 0
+
+		var rates *minRate
+		if lcfg.MinReadRate < 0 || lcfg.MinWriteRate < 0 || lcfg.MinRateWindow.Duration < 0 {
+			collectError(&errs, fmt.Errorf("Minimum rates and window must not be negative"), "Listeners", lname)
+			continue
+		}
+		if lcfg.MinReadRate != 0 || lcfg.MinWriteRate != 0 {
+			rates = &minRate{
+				name:     name + "." + lname,
+				minRead:  float64(lcfg.MinReadRate),
+				minWrite: float64(lcfg.MinWriteRate),
+				window:   lcfg.MinRateWindow.Duration,
+			}
+			if rates.window == 0 {
+				rates.window = defaultMinRateWindow
+			}
+		}
+
+		proxyListener, e := proxyproto.NewListener(lcfg.ProxyProtocol)
+		if e != nil {
+			collectError(&errs, e, "Listeners", lname, "ProxyProtocol")
+			continue
+		}
+		if proxyListener != nil && maxConnsPerIP != 0 {
+			// The client address is only known from the header read after accepting.
+			collectError(&errs, fmt.Errorf("MaxConnectionsPerIP can't be used with the PROXY protocol"), "Listeners", lname, "MaxConnectionsPerIP")
+			continue
+		}
+		if sock != nil && maxConnsPerIP != 0 {
+			// UNIX socket peers have no IP.
+			collectError(&errs, fmt.Errorf("MaxConnectionsPerIP can't be used with UNIX sockets"), "Listeners", lname, "MaxConnectionsPerIP")
+			continue
+		}
+
+		listener := listenerSpec{ListenerSpec: daemon.ListenerSpec{
+			Net:            network,
 			Addr:           addr,
 			TLSConfig:      tlsCfg,
 			ListenerFdName: lcfg.SocketFdName,
 			InheritOnly:    lcfg.SocketInheritOnly,
+		}}
+		if tcp != nil {
+			listener.acceptors = tcp.acceptors
 		}
+		listener.socket = sock
 
 
 		to := lcfg.IOActivityTimeout.Duration
 		reaperInterval := to / time.Duration(2)
 
+		lname := lname
 		listener.PrepareListener = func(lin net.Listener) (lout net.Listener) {
+			if sock != nil {
+				lin = sock.prepare(lin)
+			}
+			listenerAddrs.set(name, lname, lin.Addr())
+			log.INFO("Listening", "server", name, "listener", lname, "addr", lin.Addr())
+			if tcp != nil {
+				lin = tcp.prepare(lin)
+			}
+			if limited {
+				// Kept across reloads to count the connections of previous generations.
+				limiter := listenerLimits.get(name, lname)
+				limiter.setLimits(maxConns, maxConnsPerIP)
+				lin = limiter.wrap(lin)
+			}
+			if proxyListener != nil {
+				// Inside the reaper, which must see the connections the HTTP server sees.
+				lin = proxyListener.Wrap(lin)
+			}
 			lout = reaper.NewIOActivityTimeoutListener(lin, to, reaperInterval)
+			if rates != nil {
+				// Outside the reaper for the HTTP server to enable enforcement on the connections it sees.
+				lout = rates.wrap(lout)
+			}
 			return
 		}
 
-		listeners = append(listeners, listener)
+		listeners.specs = append(listeners.specs, listener)
+	}
+
+	if cfg.MaxHeaderBytes < 0 {
+		collectError(&errs, fmt.Errorf("MaxHeaderBytes must not be negative"), "MaxHeaderBytes")
+	}
+	if cfg.MaxRequestBody < 0 {
+		collectError(&errs, fmt.Errorf("MaxRequestBody must not be negative"), "MaxRequestBody")
+	}
+
+	if len(errs) != 0 {
+		return nil, errs
 	}
 
 	var configuredListeners netutil.StreamListener
-	if len(listeners) != 0 {
-		configuredListeners = listeners
+	if len(listeners.specs) != 0 {
+		configuredListeners = &listeners
 	}
 
 	// Set up a log adapter for stdlib HTTP server.
@@ -106,6 +271,7 @@ func newHTTPServer(name string, cfg config.HTTPServerConfig, snis *tlsPluginRegi
 		IdleTimeout:       cfg.IdleTimeout.Duration,
 		ReadTimeout:       cfg.ReadTimeout.Duration,
 		WriteTimeout:      cfg.WriteTimeout.Duration,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
 	}
 
 	httpserver.ConnState = reaperConnStateCallback(cfg.NewActiveTimeout.Duration)
@@ -113,6 +279,12 @@ func newHTTPServer(name string, cfg config.HTTPServerConfig, snis *tlsPluginRegi
 	if cfg.DisableKeepAlives {
 		httpserver.SetKeepAlivesEnabled(false)
 	}
+
+	httpserver.Handler, err = configureHTTP2(cfg.HTTP2, httpserver, tlsConfigs)
+	if err != nil {
+		return nil, config.AtPath(err, "HTTP2")
+	}
+
 	srv = &nshttp.Server{
 		Name:      name,
 		Server:    httpserver,
@@ -0,0 +1,82 @@
+package ozone
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// configureHTTP2 sets up HTTP/2 of a server as configured.
+// It must be called before the TLS configs of the listeners are used.
+// The returned handler serves h2c on non-TLS listeners if enabled.
+func configureHTTP2(cfg *config.HTTP2Config, srv *http.Server, tlsConfigs []*tls.Config) (handler http.Handler, err error) {
+	handler = srv.Handler
+	if cfg == nil {
+		return
+	}
+
+	if cfg.Disable {
+		// A non-nil empty map disables HTTP/2 on TLS.
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		for _, tc := range tlsConfigs {
+			tc.NextProtos = withoutProto(tc.NextProtos, http2.NextProtoTLS)
+		}
+		return
+	}
+
+	h2srv := &http2.Server{
+		MaxConcurrentStreams:         cfg.MaxConcurrentStreams,
+		MaxReadFrameSize:             cfg.MaxReadFrameSize,
+		MaxUploadBufferPerConnection: cfg.MaxUploadBufferPerConnection,
+		MaxUploadBufferPerStream:     cfg.MaxUploadBufferPerStream,
+		IdleTimeout:                  cfg.IdleTimeout.Duration,
+		PermitProhibitedCipherSuites: cfg.PermitProhibitedCipherSuites,
+	}
+	err = http2.ConfigureServer(srv, h2srv)
+	if err != nil {
+		return
+	}
+	// The daemon wraps the listeners in TLS itself, so advertise HTTP/2 in their configs.
+	for _, tc := range tlsConfigs {
+		tc.NextProtos = append([]string{http2.NextProtoTLS}, withoutProto(tc.NextProtos, http2.NextProtoTLS)...)
+		if !hasProto(tc.NextProtos, "http/1.1") {
+			tc.NextProtos = append(tc.NextProtos, "http/1.1")
+		}
+	}
+
+	if cfg.H2C {
+		h2cHandler := h2c.NewHandler(handler, h2srv)
+		plain := handler
+		handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil {
+				// h2c is for cleartext connections only.
+				plain.ServeHTTP(w, r)
+				return
+			}
+			h2cHandler.ServeHTTP(w, r)
+		})
+	}
+	return
+}
+
+func hasProto(protos []string, proto string) bool {
+	for _, p := range protos {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutProto(protos []string, proto string) (out []string) {
+	for _, p := range protos {
+		if p != proto {
+			out = append(out, p)
+		}
+	}
+	return
+}
@@ -0,0 +1,95 @@
+package ozone
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/One-com/gone/log"
+)
+
+// States of the daemon reported by the Health and Ready handlers.
+const (
+	stateConfiguring = "configuring" // loading the first config
+	stateReady       = "ready"       // serving
+	stateDraining    = "draining"    // shutting down - still serving for the drain delay
+)
+
+// lifecycle tracks the state of the daemon, so load balancers can stop sending requests
+// before the listeners close on a graceful shutdown.
+type lifecycle struct {
+	mu    sync.Mutex
+	state string
+	run   int // counts resets to ignore drains of previous runs
+}
+
+var daemonState = &lifecycle{state: stateConfiguring}
+
+func (l *lifecycle) get() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.state
+}
+
+// reset makes the state configuring for the next run of the daemon - ignoring pending drains.
+func (l *lifecycle) reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.state = stateConfiguring
+	l.run++
+}
+
+// ready is called when the servers are listening. A draining daemon stays draining.
+func (l *lifecycle) ready() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state == stateConfiguring {
+		l.state = stateReady
+	}
+}
+
+// drain makes the daemon report it's draining and calls exit after the delay.
+// Draining again just waits for the first drain.
+func (l *lifecycle) drain(delay time.Duration, exit func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state == stateDraining {
+		log.NOTICE("Already draining")
+		return
+	}
+	l.state = stateDraining
+	if delay == 0 {
+		exit()
+		return
+	}
+	log.NOTICE("Draining before shutdown", "delay", delay)
+	run := l.run
+	time.AfterFunc(delay, func() {
+		l.mu.Lock()
+		current := l.run == run
+		l.mu.Unlock()
+		if current {
+			exit()
+		}
+	})
+}
+
+// healthHandler answers 200 while the daemon is running - also while draining.
+var healthHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintln(w, daemonState.get())
+})
+
+// readyHandler answers 200 when the daemon is ready to serve and 503 while configuring
+// or draining.
+var readyHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	state := daemonState.get()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if state != stateReady {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintln(w, state)
+})
@@ -0,0 +1,120 @@
+package ozone
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// boundAddrs records the addresses listeners are actually bound to, which is the only
+// way to know the port of listeners configured with port 0.
+type boundAddrs struct {
+	mu    sync.Mutex
+	addrs map[string]map[string]net.Addr // server -> listener -> address
+}
+
+var listenerAddrs = &boundAddrs{addrs: make(map[string]map[string]net.Addr)}
+
+// set records the address of a listener when it starts listening.
+func (b *boundAddrs) set(server, listener string, addr net.Addr) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.addrs[server] == nil {
+		b.addrs[server] = make(map[string]net.Addr)
+	}
+	b.addrs[server][listener] = addr
+}
+
+// lookup returns the recorded address of a listener - or nil.
+func (b *boundAddrs) lookup(server, listener string) net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.addrs[server][listener]
+}
+
+// retain forgets the listeners not in the config of the servers.
+func (b *boundAddrs) retain(servers config.HTTPServersConfig) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for server, listeners := range b.addrs {
+		srvCfg, ok := servers[server]
+		if !ok {
+			delete(b.addrs, server)
+			continue
+		}
+		for listener := range listeners {
+			if _, ok := srvCfg.Listeners[listener]; !ok {
+				delete(listeners, listener)
+			}
+		}
+	}
+}
+
+// reset forgets all listeners.
+func (b *boundAddrs) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.addrs = make(map[string]map[string]net.Addr)
+}
+
+// get returns a copy of the recorded addresses.
+func (b *boundAddrs) get() map[string]map[string]net.Addr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	addrs := make(map[string]map[string]net.Addr, len(b.addrs))
+	for server, listeners := range b.addrs {
+		addrs[server] = make(map[string]net.Addr, len(listeners))
+		for listener, addr := range listeners {
+			addrs[server][listener] = addr
+		}
+	}
+	return addrs
+}
+
+// ListenerAddrs returns the addresses the listeners of the running HTTP servers are bound to - by
+// server and listener name. Listeners configured with port 0 are bound to a port chosen by the OS.
+// Use the ReadyCallback Option to know when the servers are listening.
+func ListenerAddrs() map[string]map[string]net.Addr {
+	return listenerAddrs.get()
+}
+
+// ---------------------------------------------------------------
+// A control socket command listing where the servers listen
+
+var serversControl = &serversCommand{}
+
+type serversCommand struct{}
+
+func (c *serversCommand) ShortUsage() (syntax, comment string) {
+	comment = "list the listeners of the HTTP servers and their addresses"
+	return
+}
+
+func (c *serversCommand) Usage(cmd string, w io.Writer) {
+	fmt.Fprintln(w, cmd, "lists \"<server> <listener> <address>\" for all listening listeners")
+}
+
+func (c *serversCommand) Invoke(ctx context.Context, w io.Writer, cmd string, args []string) (async func(), persistent string, err error) {
+	addrs := listenerAddrs.get()
+	servers := make([]string, 0, len(addrs))
+	for server := range addrs {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		listeners := make([]string, 0, len(addrs[server]))
+		for listener := range addrs[server] {
+			listeners = append(listeners, listener)
+		}
+		sort.Strings(listeners)
+		for _, listener := range listeners {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", server, listener, addrs[server][listener])
+		}
+	}
+	return
+}
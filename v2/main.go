@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -13,6 +14,8 @@ import (
 	"github.com/One-com/gone/log"
 	"github.com/One-com/gone/log/syslog"
 	"github.com/One-com/gone/signals"
+
+	"github.com/One-com/ozone/v2/config"
 )
 
 func init() {
@@ -22,7 +25,7 @@ func init() {
 
 // configDumper writes configuration to the supplied writer.
 type configDumper interface {
-	Dump(io.Writer)
+	DumpFormat(io.Writer, config.Format) error
 }
 
 type dryRunFunc func() (configDumper, error)
@@ -33,17 +36,40 @@ type dryRunFunc func() (configDumper, error)
 // Calling configF will then return the initalized server ready for running.
 // Calling dryrunF will throw away the server and instead dump the total parsed config to the
 // provided configDumper
+// Reloading keeps what's unchanged from the running config. See configurator.
 func loadConfig(cfgSpec interface{}) (configF daemon.ConfigFunc, dryrunF dryRunFunc) {
 
+	configurator := &configurator{cfgSpec: cfgSpec}
+
 	configFunc := func() (s []daemon.Server, c []daemon.CleanupFunc, newCfg configDumper, err error) {
 		log.INFO("Loading config")
-		s, c, newCfg, err = instantiateServersFromConfig(cfgSpec)
+		reloading := configurator.running != nil
+		seq := reloads.start()
+		var summary reloadSummary
+		var loaded *config.Config
+		s, c, loaded, summary, err = configurator.configure()
 		if err != nil {
+			reloads.done(seq, reloadResult{err: err})
 			var filename string
 			if f, ok := cfgSpec.(string); ok {
 				filename = f
 			}
 			log.CRIT("Error configuring services", "file", filename, "err", err)
+			return
+		}
+		reloads.configured(seq, reloadResult{summary: summary})
+		newCfg = loaded
+		loadedConfigs.add(loaded)
+		listenerAddrs.retain(loaded.HTTPServers)
+		listenerLimits.retain(loaded.HTTPServers)
+		unixSocketFiles.retain(loaded.HTTPServers)
+		if reloading {
+			log.NOTICE("Reloaded config",
+				"started", strings.Join(summary.Started, ","),
+				"restarted", strings.Join(summary.Restarted, ","),
+				"kept", strings.Join(summary.Kept, ","),
+				"stopped", strings.Join(summary.Stopped, ","),
+				"handlers", strings.Join(summary.Handlers, ","))
 		}
 		return
 	}
@@ -75,9 +101,12 @@ func onSignalExit() {
 }
 
 // onSignalExitGraceful will ask the daemon to exit waiting for graceful shutdown
+// - after the drain delay.
 func onSignalExitGraceful() {
 	log.Println("Signal Exit")
-	daemon.Exit(true)
+	daemonState.drain(cfg.draindelay, func() {
+		daemon.Exit(true)
+	})
 }
 
 // onSignalReload will ask the daemon to configure a new set of server objects
@@ -91,7 +120,10 @@ func onSignalReload() {
 // which will then ask the old daemon process to shutdown.
 func onSignalRespawn() {
 	log.Println("Signal Respawn")
-	daemon.ReplaceProcess(syscall.SIGTERM)
+	if _, err := daemon.ReplaceProcess(syscall.SIGTERM); err == nil {
+		// The new process serves the UNIX socket files now.
+		unixSocketFiles.handOver()
+	}
 }
 
 // onSignalIncLogLevel will increase the log level for the default logger.
@@ -139,20 +171,34 @@ var HandledSignals = signals.Mappings{
 
 type runcfg struct {
 	dryrun          bool           // just call dryrunF and exit.
+	validate        bool           // just validate the config and exit.
+	schema          bool           // just write the config JSON Schema and exit.
+	watch           bool           // reload when the config files change.
+	format          config.Format  // of config files with no known format extension
+	dumpformat      config.Format  // format of the dumped config
 	controlsocket   string         // path of the UNIX control socket
 	shutdowntimeout time.Duration  // default delay to wait for graceful shutdown
+	draindelay      time.Duration  // delay reporting not ready before closing listeners on graceful shutdown
 	readymessage    string         // Message to send over systemd notify socket when ready
+	history         int            // number of loaded configs kept for the "config" control command
+	ready           func()         // called when the servers are listening
 }
 
 // Option to pass to Init()
 type Option func(*runcfg)
 
-// Default Config
-var cfg = runcfg{
+// Default Config - with the options given to Init()
+var initcfg = runcfg{
 	readymessage:    "Ready and serving",
 	controlsocket:   "./ozone-control.sock",
+	format:          config.FormatJSON,
+	dumpformat:      config.FormatJSON,
+	history:         10,
 }
 
+// Config of the running Ozone - initcfg with the options given to Main()
+var cfg = initcfg
+
 // DumpConfig makes Ozone dry-run and exit after dumping the parsed configuration to os.Stdout
 func DumpConfig(dryrun bool) Option {
 	return Option(func(c *runcfg) {
@@ -160,6 +206,67 @@ func DumpConfig(dryrun bool) Option {
 	})
 }
 
+// DumpConfigFormat sets the format (JSON, YAML or TOML) of the config dumped by DumpConfig.
+// It defaults to JSON.
+func DumpConfigFormat(format config.Format) Option {
+	return Option(func(c *runcfg) {
+		c.dumpformat = format
+	})
+}
+
+// ConfigFormat sets the format (JSON, YAML or TOML) of config files whose extension
+// is not ".json", ".yaml", ".yml" or ".toml" - and of in memory configs.
+// It defaults to JSON.
+func ConfigFormat(format config.Format) Option {
+	return Option(func(c *runcfg) {
+		c.format = format
+	})
+}
+
+// DumpSchema makes Ozone write a JSON Schema for the config to os.Stdout and exit.
+// The schema includes the config of all handler types, TLS plugin types and reverse proxy
+// modules having registered a schema.
+func DumpSchema(schema bool) Option {
+	return Option(func(c *runcfg) {
+		c.schema = schema
+	})
+}
+
+// ValidateConfig makes Ozone configure everything in the config without binding any listeners,
+// report all errors found to os.Stdout - each located by its path in the config - and exit.
+func ValidateConfig(validate bool) Option {
+	return Option(func(c *runcfg) {
+		c.validate = validate
+	})
+}
+
+// WatchConfig makes Ozone watch the config file and all included files (using inotify)
+// and reload when they change. The reload configures everything before replacing the running
+// servers, so an invalid or half written config file is ignored - until it's changed again.
+// Only configs given as a file name (or directory) are watched.
+func WatchConfig(watch bool) Option {
+	return Option(func(c *runcfg) {
+		c.watch = watch
+	})
+}
+
+// ConfigHistory sets how many successfully loaded configs the "config" control command
+// keeps to show and diff. It defaults to 10.
+func ConfigHistory(n int) Option {
+	return Option(func(c *runcfg) {
+		c.history = n
+	})
+}
+
+// ReadyCallback sets a function to call when the servers of the config are listening
+// and serving - on start and after every reload. ListenerAddrs tells where they listen.
+// It replaces any function set earlier.
+func ReadyCallback(f func()) Option {
+	return Option(func(c *runcfg) {
+		c.ready = f
+	})
+}
+
 // ControlSocket specifies an alternative path for the daemon
 // control socket. If "", the socket is disabled.
 // The socket defaults to "ozone-control.sock" in the current working directory.
@@ -179,6 +286,15 @@ func ShutdownTimeout(to time.Duration) Option {
 	})
 }
 
+// DrainDelay sets how long to keep serving after a graceful shutdown (SIGTERM or "daemon stop")
+// has started before closing the listeners. During the delay the Ready handler answers 503, so
+// load balancers stop sending requests before the listeners close.
+func DrainDelay(d time.Duration) Option {
+	return Option(func(c *runcfg) {
+		c.draindelay = d
+	})
+}
+
 // SdNotifyReadyMessage changes the default message to send to systemd
 // via the notify socket.
 func SdNotifyReadyMessage(msg string) Option {
@@ -211,8 +327,10 @@ func internalInit(doinit bool, opts ...Option) {
 
 	// initialize config from options
 	for _, o := range opts {
+		o(&initcfg)
 		o(&cfg)
 	}
+	loadedConfigs.setSize(cfg.history)
 
 	// Setup default ozone configuration unless disabled.
 	// If you want something else, call DisableInit() instead of Init()
@@ -225,6 +343,9 @@ func internalInit(doinit bool, opts ...Option) {
 		if doinit {
 			daemon.SetLogger(serverLogFunc)
 			ctrl.RegisterCommand("daemon", procControl)
+			ctrl.RegisterCommand("config", configControl)
+			ctrl.RegisterCommand("servers", serversControl)
+			ctrl.RegisterCommand("connections", connectionsControl)
 			signals.RunSignalHandler(HandledSignals)
 		}
 	})
@@ -233,19 +354,59 @@ func internalInit(doinit bool, opts ...Option) {
 // Main starts Ozone serving, by parsing the provided config file
 // and serving everything defined in it by calling github.com/One-com/gone/daemon.Run().
 // Main can be provided options which will overwrite any options given to Init()
+// until Main returns.
 func Main(filename string, opts ...Option) error {
 
 	return ozonemain(filename, opts...)
 
 }
 
+// ConfigProvider returns the config to serve. It's called on start and on every reload,
+// so it can build the config in Go or fetch it from wherever the application keeps it.
+// Handler and TLS plugin configs (jconf sub configs) are parsed from their RawMessage,
+// so set that - e.g. using json.Marshal - for configs built in Go.
+type ConfigProvider func() (*config.Config, error)
+
+// MainWithConfigProvider starts Ozone serving like Main, but gets the config from
+// the provider instead of a config file.
+// Since there's no config file, the WatchConfig Option has no effect.
+func MainWithConfigProvider(provider ConfigProvider, opts ...Option) error {
+
+	return ozonemain(provider, opts...)
+
+}
+
 // ozonemain takes config as an interface to allow for an in memory buffer during tests
 func ozonemain(config interface{}, opts ...Option) error {
 
-	Init(opts...)
+	Init()
+
+	// Options given to Main only apply to this run
+	cfg = initcfg
+	for _, o := range opts {
+		o(&cfg)
+	}
+	loadedConfigs.setSize(cfg.history)
+	defer func() {
+		cfg = initcfg
+	}()
+
+	if cfg.schema {
+		return writeSchema(os.Stdout)
+	}
 
 	configureFunc, dryrunFunc := loadConfig(config)
 
+	if cfg.validate {
+		err := validateConfig(config)
+		if err != nil {
+			writeConfigErrors(os.Stdout, err)
+			return err
+		}
+		fmt.Fprintln(os.Stdout, "Config OK")
+		return nil
+	}
+
 	if cfg.dryrun {
 		newCfg, err := dryrunFunc()
 		if err != nil {
@@ -256,8 +417,7 @@ func ozonemain(config interface{}, opts ...Option) error {
 			log.CRIT("Error parsing config file", "file", filename, "err", err)
 			return err
 		}
-		newCfg.Dump(os.Stdout)
-		return err
+		return newCfg.DumpFormat(os.Stdout, cfg.dumpformat)
 	}
 
 	runoptions := []daemon.RunOption{
@@ -266,11 +426,38 @@ func ozonemain(config interface{}, opts ...Option) error {
 		daemon.ShutdownTimeout(cfg.shutdowntimeout),
 		daemon.SdNotifyOnReady(true, cfg.readymessage),
 		daemon.SignalParentOnReady(),
+		daemon.ReadyCallback(func() error {
+			daemonState.ready()
+			reloads.serving()
+			return nil
+		}),
+	}
+	if ready := cfg.ready; ready != nil {
+		runoptions = append(runoptions, daemon.ReadyCallback(func() error {
+			ready()
+			return nil
+		}))
+	}
+
+	if filename, ok := config.(string); ok && cfg.watch {
+		stop, err := watchConfig(filename, onSignalReload)
+		if err != nil {
+			log.ERROR("Unable to watch config", "file", filename, "err", err)
+		} else {
+			defer stop()
+		}
 	}
 
 	log.NOTICE("Starting server", "pid", os.Getpid())
 
 	err := daemon.Run(runoptions...)
+	if err != nil {
+		reloads.failed(err)
+	}
+	listenerAddrs.reset()
+	listenerLimits.reset()
+	unixSocketFiles.reset()
+	daemonState.reset()
 	if err != nil {
 		log.CRIT("Daemon exit error", "err", err)
 	}
@@ -0,0 +1,119 @@
+package ozone
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/One-com/gone/jconf"
+	"github.com/One-com/gone/log"
+
+	"github.com/One-com/ozone/v2/config"
+	"github.com/One-com/ozone/v2/handlers/compress"
+)
+
+// MiddlewareConfigureFunc is called to wrap a handler in a middleware configured from a JSON config stanza.
+// Each registered middleware type must define such a function.
+type MiddlewareConfigureFunc func(cfg jconf.SubConfig, next http.Handler) (http.Handler, error)
+
+var middlewareTypes = map[string]MiddlewareConfigureFunc{
+	"Recover":  makeRecoverMiddleware,
+	"Headers":  makeHeadersMiddleware,
+	"Compress": makeCompressMiddleware,
+}
+
+// RegisterMiddlewareType defines a middleware type, so it can be used in the "Middleware"
+// lists of servers and handlers in the config file by "Type".
+// Not go-routine safe.
+func RegisterMiddlewareType(typename string, f MiddlewareConfigureFunc) {
+	middlewareTypes[typename] = f
+}
+
+// wrapMiddleware wraps a handler in the configured middleware - the first in the list being outermost.
+// Errors are located relative to the middleware list.
+func wrapMiddleware(handler http.Handler, mws []config.MiddlewareConfig) (http.Handler, error) {
+	for i := len(mws) - 1; i >= 0; i-- {
+		f, ok := middlewareTypes[mws[i].Type]
+		if !ok {
+			return nil, config.AtPath(fmt.Errorf("No such Middleware type: %s", mws[i].Type), strconv.Itoa(i), "Type")
+		}
+		h, err := f(mws[i].Config, handler)
+		if err != nil {
+			return nil, config.AtPath(err, strconv.Itoa(i), "Config")
+		}
+		handler = h
+	}
+	return handler, nil
+}
+
+// middlewareFingerprint identifies the config of a middleware list.
+func middlewareFingerprint(mws []config.MiddlewareConfig) string {
+	parts := make([]string, 0, 2*len(mws))
+	for _, mw := range mws {
+		var raw []byte
+		if mw.Config != nil {
+			raw = compactJSON(mw.Config.RawMessage)
+		}
+		parts = append(parts, mw.Type, string(raw))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// ---------------------------------------------------------------
+// Built-in middleware
+
+// makeRecoverMiddleware makes a middleware answering 500 when the handler panics - logging the panic
+// instead of having the server close the connection.
+func makeRecoverMiddleware(js jconf.SubConfig, next http.Handler) (http.Handler, error) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				log.ERROR("Handler panic", "url", r.URL.String(), "panic", fmt.Sprint(p), "stack", string(debug.Stack()))
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	}), nil
+}
+
+// makeCompressMiddleware makes a middleware compressing responses (see compress.Config).
+func makeCompressMiddleware(js jconf.SubConfig, next http.Handler) (http.Handler, error) {
+	c, err := compress.New(js)
+	if err != nil {
+		return nil, err
+	}
+	return c.Wrap(next), nil
+}
+
+// HeadersMiddlewareConfig is the config of the "Headers" middleware setting headers
+// of requests before passing them on and of responses before the handler writes them.
+// A request header with an empty value is removed.
+type HeadersMiddlewareConfig struct {
+	Request  map[string]string `json:",omitempty"`
+	Response map[string]string `json:",omitempty"`
+}
+
+func makeHeadersMiddleware(js jconf.SubConfig, next http.Handler) (http.Handler, error) {
+	cfg := new(HeadersMiddlewareConfig)
+	if err := js.ParseInto(cfg); err != nil {
+		return nil, err
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range cfg.Request {
+			if value == "" {
+				r.Header.Del(name)
+			} else {
+				r.Header.Set(name, value)
+			}
+		}
+		for name, value := range cfg.Response {
+			w.Header().Set(name, value)
+		}
+		next.ServeHTTP(w, r)
+	}), nil
+}
@@ -0,0 +1,248 @@
+package ozone
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/One-com/gone/log"
+	"github.com/One-com/gone/metric"
+)
+
+// defaultMinRateWindow is the default period over which the data rate of connections is measured.
+const defaultMinRateWindow = 10 * time.Second
+
+// writeChunk is the most written at a time to connections with a minimum write rate - to see
+// the progress of large writes.
+const writeChunk = 8192
+
+// minRate are the minimum data rates of the connections of a listener.
+type minRate struct {
+	name     string  // "<server>.<listener>" - for logging and metrics
+	minRead  float64 // bytes/sec - 0 for no minimum
+	minWrite float64
+	window   time.Duration
+}
+
+// wrap returns a listener closing connections which transfer data slower than the minimum rates
+// while serving requests. Like the reaper, it must wrap the connections seen by the HTTP server
+// (only wrapped in TLS) for the server to tell when connections are idle or hijacked.
+func (r *minRate) wrap(inner net.Listener) net.Listener {
+	return &rateListener{Listener: inner, minRate: r, conns: make(map[*rateConn]struct{})}
+}
+
+// rateListener is a listener of a single generation of servers. A monitor go-routine catches
+// connections stuck writing - while there are connections.
+type rateListener struct {
+	net.Listener
+	*minRate
+
+	mu         sync.Mutex
+	conns      map[*rateConn]struct{}
+	monitoring bool
+}
+
+func (l *rateListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	rc := &rateConn{Conn: c, l: l}
+
+	l.mu.Lock()
+	l.conns[rc] = struct{}{}
+	if !l.monitoring && l.minWrite != 0 {
+		l.monitoring = true
+		go l.monitor()
+	}
+	l.mu.Unlock()
+	return rc, nil
+}
+
+func (l *rateListener) remove(c *rateConn) {
+	l.mu.Lock()
+	delete(l.conns, c)
+	l.mu.Unlock()
+}
+
+// monitor checks connections blocked writing every half window. It exits when there have been no
+// connections for 2 checks and is restarted by Accept.
+func (l *rateListener) monitor() {
+	ticker := time.NewTicker(l.window / 2)
+	defer ticker.Stop()
+
+	var empty int
+	for range ticker.C {
+		l.mu.Lock()
+		if len(l.conns) == 0 {
+			if empty++; empty >= 2 {
+				l.monitoring = false
+				l.mu.Unlock()
+				return
+			}
+		} else {
+			empty = 0
+		}
+		conns := make([]*rateConn, 0, len(l.conns))
+		for c := range l.conns {
+			conns = append(conns, c)
+		}
+		l.mu.Unlock()
+
+		now := time.Now()
+		for _, c := range conns {
+			c.checkBlockedWrite(now)
+		}
+	}
+}
+
+// transfer is the data transferred in one direction in the current window.
+type transfer struct {
+	bytes int64
+	busy  time.Duration // time spent in Read or Write calls transferring the bytes
+}
+
+// rateConn measures the data rate of a connection. Only time spent in Read and Write calls while
+// serving a request counts - from the server having read the request headers (http.StateActive) to
+// it waiting for the next request (http.StateIdle). Waiting for a client to send a request (like after
+// the TLS handshake) is being idle, which is left to the IOActivityTimeout and server timeouts.
+type rateConn struct {
+	net.Conn
+	l *rateListener
+
+	stopped int32 // atomic
+	closed  int32 // atomic
+
+	mu           sync.Mutex
+	read, write  transfer
+	serving      bool      // a request is being served
+	writingSince time.Time // zero if not blocked writing
+}
+
+// active starts measuring when the headers of a request have been read.
+func (c *rateConn) active() {
+	c.mu.Lock()
+	c.serving = true
+	c.mu.Unlock()
+}
+
+// idle stops measuring and starts a new window when the connection waits for the next request.
+func (c *rateConn) idle() {
+	c.mu.Lock()
+	c.read, c.write = transfer{}, transfer{}
+	c.serving = false
+	c.mu.Unlock()
+}
+
+// stop stops enforcing the minimum rates - for hijacked connections.
+func (c *rateConn) stop() {
+	atomic.StoreInt32(&c.stopped, 1)
+}
+
+func (c *rateConn) isEnforced() bool {
+	return atomic.LoadInt32(&c.stopped) == 0
+}
+
+func (c *rateConn) Read(b []byte) (n int, err error) {
+	if c.l.minRead == 0 || !c.isEnforced() {
+		return c.Conn.Read(b)
+	}
+	start := time.Now()
+	n, err = c.Conn.Read(b)
+	if n > 0 {
+		c.account(&c.read, n, time.Since(start), c.l.minRead, "read")
+	}
+	return
+}
+
+func (c *rateConn) Write(b []byte) (n int, err error) {
+	if c.l.minWrite == 0 || !c.isEnforced() {
+		return c.Conn.Write(b)
+	}
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > writeChunk {
+			chunk = chunk[:writeChunk]
+		}
+		start := time.Now()
+		c.mu.Lock()
+		c.writingSince = start
+		c.mu.Unlock()
+
+		var written int
+		written, err = c.Conn.Write(chunk)
+
+		c.mu.Lock()
+		c.writingSince = time.Time{}
+		c.mu.Unlock()
+
+		n += written
+		c.account(&c.write, written, time.Since(start), c.l.minWrite, "write")
+		if err != nil {
+			return
+		}
+		b = b[written:]
+	}
+	return
+}
+
+// account adds a transfer to the window - checking the rate when the window is full.
+// Transfers while not serving a request are ignored.
+func (c *rateConn) account(t *transfer, n int, d time.Duration, min float64, direction string) {
+	c.mu.Lock()
+	if !c.serving {
+		c.mu.Unlock()
+		return
+	}
+	t.bytes += int64(n)
+	t.busy += d
+	var rate float64
+	full := t.busy >= c.l.window
+	if full {
+		rate = float64(t.bytes) / t.busy.Seconds()
+		*t = transfer{}
+	}
+	c.mu.Unlock()
+
+	if full && rate < min && c.isEnforced() {
+		c.slow(direction, rate)
+	}
+}
+
+// checkBlockedWrite checks the write rate of a connection blocked writing.
+func (c *rateConn) checkBlockedWrite(now time.Time) {
+	if !c.isEnforced() {
+		return
+	}
+	c.mu.Lock()
+	var rate float64
+	var full bool
+	if c.serving && !c.writingSince.IsZero() {
+		busy := c.write.busy + now.Sub(c.writingSince)
+		if full = busy >= c.l.window; full {
+			rate = float64(c.write.bytes) / busy.Seconds()
+		}
+	}
+	c.mu.Unlock()
+
+	if full && rate < c.l.minWrite {
+		c.slow("write", rate)
+	}
+}
+
+// slow closes a connection which is too slow. The HTTP server sees I/O errors and closes it too.
+func (c *rateConn) slow(direction string, rate float64) {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return
+	}
+	log.INFO("Closing slow connection", "listener", c.l.name, "addr", c.RemoteAddr(), "direction", direction, "rate", int64(rate))
+	metric.AdhocCount(c.l.name+".conn-slow", 1, false)
+	c.Conn.Close()
+}
+
+func (c *rateConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	c.l.remove(c)
+	return c.Conn.Close()
+}
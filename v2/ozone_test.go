@@ -1,145 +1,37 @@
 package ozone
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/One-com/gone/daemon"
 	"github.com/One-com/gone/jconf"
 	"github.com/One-com/gone/log"
+	"github.com/One-com/gone/metric"
+	"github.com/One-com/gone/metric/num64"
+	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
-	"time"
 
-	stdlog "log"
+	"github.com/One-com/ozone/v2/config"
 )
 
 func init() {
 	log.SetOutput(ioutil.Discard)
 }
 
-func TestMain(m *testing.M) {
-
-	Init(ControlSocket("@ozonetest"))
-
-	os.Exit(m.Run())
-}
-
-// used by tests to shutdown the test server via the control socket
-func shutdown(t *testing.T) {
-	time.Sleep(100*time.Millisecond)
-	addr, err := net.ResolveUnixAddr("unix", "@ozonetest")
-	if err != nil {
-		t.Fatal(err)
-	}
-	tries := 0
-	for {
-		time.Sleep(100 * time.Millisecond)
-		stopconn, err := net.DialUnix("unix", nil, addr)
-		if err == nil && stopconn != nil {
-			stopconn.Write([]byte("daemon stop\n"))
-			stopconn.Close() // Close the conn to not re-establish it in next test
-			break
-		}
-		tries++
-		if tries == 4 {
-			t.Error("Too many shutdown tries")
-		}
-
-	}
-}
-
-var stopconfig = `{
-    "HTTP" : {
-        "TestServer" : {
-            "Listeners" : {
-                "http" : {
-                    "Port" : 8180
-                }
-            },
-            "Handler" : "NotFound"
-        }
-    }
-}
-`
-
-// TestStop just tests the stop function.
-func TestStop(t *testing.T) {
-	var done = make(chan struct{})
-	// Close the done chan when main exits (as it should)
-	go func() {
-		err := ozonemain(strings.NewReader(stopconfig))
-		if err != nil {
-			stdlog.Fatal(err)
-		}
-		close(done)
-	}()
-
-	shutdown(t)
-	<-done
-}
-
 //----------------------------------------------------
 
-const teststring = "test ok\n"
-
-var ozoneTestHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-	w.Write([]byte(teststring))
-})
-
-func init() {
-	RegisterStaticHTTPHandler("OzoneTest", ozoneTestHandler)
-}
-
-var answerRequestConfig = `{
-    "HTTP" : {
-        "HelloServer" : {
-            "Listeners" : {
-                "http" : {
-                    "Port" : 8180
-                }
-            },
-            "Handler" : "OzoneTest"
-        }
-    }
-}
-`
-// TestAnswerRequest verifies that a handler can respond to requests
-func TestAnswerRequest(t *testing.T) {
-	var done = make(chan struct{})
-	go func() {
-		err := ozonemain(strings.NewReader(answerRequestConfig))
-		if err != nil {
-			stdlog.Fatal(err)
-		}
-		close(done)
-	}()
-
-	resp, err := http.Get("http://localhost:8180")
-	if err != nil {
-		t.Fatal(err)
-	}
-	data, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if string(data) != teststring {
-		t.Error("No ok response")
-	}
-
-	shutdown(t)
-	<-done
-}
-
-//----------------------------------------------------
-
-// Test create 2 HTTP server and a proxy which puts the 2 servers in a backend cluster.
-// Test that there's a reasonable load balancing between the two servers.
+// A proxy which puts 2 HTTP servers in a backend cluster.
 
 type handlerConfig struct {
 	Reply string
+	File  string `json:",omitempty"` // declared as read by the handler
 }
 
 func createHandler(name string, js jconf.SubConfig, handlerByName func(string) (http.Handler, error)) (h http.Handler, cleanup func() error, err error) {
@@ -156,6 +48,14 @@ func createHandler(name string, js jconf.SubConfig, handlerByName func(string) (
 
 func init() {
 	RegisterHTTPHandlerType("testhandler", createHandler)
+	RegisterHTTPHandlerSchema("testhandler", &handlerConfig{})
+	RegisterHTTPHandlerFiles("testhandler", func(js jconf.SubConfig) []string {
+		var cfg *handlerConfig
+		if js.ParseInto(&cfg) != nil || cfg == nil || cfg.File == "" {
+			return nil
+		}
+		return []string{cfg.File}
+	})
 }
 
 var proxyConfig = `{
@@ -240,141 +140,529 @@ var proxyConfig = `{
 }
 `
 
-func TestProxy(t *testing.T) {
-	var done = make(chan struct{})
-	go func() {
-		err := ozonemain(strings.NewReader(proxyConfig))
-		if err != nil {
-			stdlog.Fatal(err)
-		}
-		close(done)
-	}()
-
-	time.Sleep(time.Second)
-
-	var replies []string
-
-	for i := 0; i < 10; i++ {
-		resp, err := http.Get("http://localhost:8180")
-		if err != nil {
-			t.Fatal(err)
-		}
-		data, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			t.Fatal(err)
-		}
-
-		replies = append(replies, string(data))
-	}
-	shutdown(t)
-	<-done
-
-	var c1, c2 int
-	var maxdiff = 2
-	for _, r := range replies {
-		switch r {
-		case "1":
-			c1++
-		case "2":
-			c2++
-		default:
-			t.Fail()
-		}
-	}
-	if c2-c1 > maxdiff || c1-c2 > maxdiff {
-		t.Error("Proxy cluster not balanced")
-	}
-}
-
 //----------------------------------------------------------------
-var recursiveConfig = `{
+var invalidConfig = `{
     "HTTP" : {
-        "Main" : {
+        "api" : {
             "Listeners" : {
                 "http" : {
                     "Port" : 8180
                 }
             },
-            "Handler" : "handler1"
+            "Handler" : "api"
+        },
+        "files" : {
+            "Listeners" : {
+                "sock" : {
+                    "Network" : "unix",
+                    "Path" : "/run/ozone/files.sock",
+                    "Mode" : "999"
+                },
+                "socket" : {
+                    "Network" : "unix",
+                    "Path" : "@ozone-files",
+                    "MaxConnectionsPerIP" : 2
+                },
+                "tcp" : {
+                    "Port" : 8182,
+                    "Acceptors" : 4
+                },
+                "proxied" : {
+                    "Port" : 8183,
+                    "MaxConnectionsPerIP" : 2,
+                    "ProxyProtocol" : { "Mode" : "required" }
+                }
+            },
+            "Handler" : "NotFound"
+        },
+        "other" : {
+            "Listeners" : {
+                "http" : {
+                    "Port" : 8181
+                }
+            },
+            "Handler" : "nosuchhandler"
         }
     },
     "Handlers" : {
-        "handler1" : {
-             "Type" : "rhandler",
+        "api" : {
+             "Type" : "ReverseProxy",
              "Config" : {
-                   "Handler" : "handler2"
-              }
+                "ModuleOrder" : ["hdr"],
+                "Modules": {
+                    "hdr" : {
+                        "Type": "set_header",
+                        "Config": {
+                            "RequestHeader" : 5
+                        }
+                    }
+                }
+            }
         },
-        "handler2" : {
-             "Type" : "rhandler",
-             "Config" : {
-                   "Handler" : "handler3"
-              }
+        "broken" : {
+             "Type" : "nosuchtype"
         },
-        "handler3" : {
-             "Type" : "testhandler",
+        "redirect" : {
+             "Type" : "Redirect",
+             "Middleware" : [
+                 { "Type" : "Recover" },
+                 { "Type" : "nosuchmiddleware" }
+             ],
              "Config" : {
-                    "Reply" : "3"
-              }
+                 "URL" : "https://example.com/",
+                 "Code" : 301
+             }
         }
     }
 }
 `
 
-type rhandlerConfig struct {
-	Handler string
-}
+// TestValidate verifies that validation reports all errors located by their config path.
+func TestValidate(t *testing.T) {
+	err := validateConfig(strings.NewReader(invalidConfig))
+	if err == nil {
+		t.Fatal("Expected config errors")
+	}
+	errs, ok := err.(config.Errors)
+	if !ok {
+		t.Fatalf("Expected config.Errors, got %T: %s", err, err)
+	}
 
-func createRHandler(name string, js jconf.SubConfig, handlerByName func(string) (http.Handler, error)) (h http.Handler, cleanup func() error, err error) {
+	expected := []string{
+		"HTTP.files.Listeners.proxied.MaxConnectionsPerIP",
+		"HTTP.files.Listeners.sock.Mode",
+		"HTTP.files.Listeners.socket.MaxConnectionsPerIP",
+		"HTTP.files.Listeners.tcp.Acceptors",
+		"HTTP.other.Handler",
+		"Handlers.api.Config.Modules.hdr.Config.RequestHeader",
+		"Handlers.broken.Type",
+		"Handlers.redirect.Middleware.1.Type",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %s", len(expected), len(errs), err)
+	}
+	for i, e := range errs {
+		var pe *config.PathError
+		if !errors.As(e, &pe) {
+			t.Fatalf("Error not located by path: %s", e)
+		}
+		if path := strings.Join(pe.Path, "."); path != expected[i] {
+			t.Errorf("Expected error at %s, got %s", expected[i], path)
+		}
+	}
 
-	var cfg *rhandlerConfig
-	err = js.ParseInto(&cfg)
+	err = validateConfig(strings.NewReader(proxyConfig))
 	if err != nil {
-		return
+		t.Error(err)
+	}
+}
+
+//----------------------------------------------------------------
+
+// TestReload verifies that reloading keeps servers and handlers with unchanged config.
+func TestReload(t *testing.T) {
+	c := &configurator{cfgSpec: strings.NewReader(proxyConfig)}
+
+	var cleanups []daemon.CleanupFunc
+	configure := func() reloadSummary {
+		_, cl, _, summary, err := c.configure()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanups = append(cleanups, cl...)
+		return summary
 	}
-	h2, e := handlerByName(cfg.Handler)
-	if e != nil {
-		err = e
-		return
+	defer func() { runCleanups(cleanups) }()
+
+	summary := configure()
+	if len(summary.Started) != 3 || len(summary.Handlers) != 3 {
+		t.Errorf("Expected everything to start, got: %s", summary)
 	}
 
-	h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		h2.ServeHTTP(w, r)
-	})
-	return
+	summary = configure()
+	if len(summary.Kept) != 3 || len(summary.Handlers) != 0 {
+		t.Errorf("Expected everything to be kept, got: %s", summary)
+	}
+
+	c.cfgSpec = strings.NewReader(strings.Replace(proxyConfig, `"Reply" : "2"`, `"Reply" : "two"`, 1))
+	summary = configure()
+	if strings.Join(summary.Restarted, ",") != "Server2" ||
+		strings.Join(summary.Kept, ",") != "ProxyServer,Server1" ||
+		strings.Join(summary.Handlers, ",") != "handler2" {
+		t.Errorf("Expected only Server2 and handler2 to be rebuilt, got: %s", summary)
+	}
+
+	// Handlers are rebuilt when files declared by their type change - not for any file named.
+	file := filepath.Join(t.TempDir(), "reply")
+	if err := os.WriteFile(file, []byte("v1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fileConfig := strings.Replace(proxyConfig, `"Reply" : "1"`, `"Reply" : "`+file+`"`, 1)
+	fileConfig = strings.Replace(fileConfig, `"Reply" : "2"`, `"Reply" : "2", "File" : "`+file+`"`, 1)
+	c.cfgSpec = strings.NewReader(fileConfig)
+	configure()
+	if err := os.WriteFile(file, []byte("v2 - changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.cfgSpec = strings.NewReader(fileConfig)
+	summary = configure()
+	if strings.Join(summary.Handlers, ",") != "handler2" {
+		t.Errorf("Expected handler2 to be rebuilt for its changed file, got: %s", summary)
+	}
 }
 
-func init() {
-	RegisterHTTPHandlerType("rhandler", createRHandler)
+func TestReloadNotifier(t *testing.T) {
+	n := &reloadNotifier{waiters: make(map[chan reloadResult]int)}
+
+	// A configured reload is reported when serving.
+	result := n.wait()
+	n.configured(n.start(), reloadResult{summary: reloadSummary{Kept: []string{"Main"}}})
+	select {
+	case r := <-result:
+		t.Fatalf("Reload reported before serving: %+v", r)
+	default:
+	}
+	n.serving()
+	if r := <-result; r.err != nil || len(r.summary.Kept) != 1 {
+		t.Errorf("Unexpected result: %+v", r)
+	}
+
+	// ... or failed when the servers fail to listen.
+	result = n.wait()
+	n.configured(n.start(), reloadResult{})
+	n.failed(errors.New("address already in use"))
+	if r := <-result; r.err == nil || !strings.Contains(r.err.Error(), "address already in use") {
+		t.Errorf("Expected listen error, got: %+v", r)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	s := ConfigSchema()
+	if s["$schema"] != config.SchemaDraft {
+		t.Fatalf("Missing $schema: %v", s["$schema"])
+	}
+
+	typed := func(s config.Schema, typename string) config.Schema {
+		conditions, _ := s["allOf"].([]interface{})
+		for _, c := range conditions {
+			cond := c.(config.Schema)
+			if cond["if"].(config.Schema).Property("Type")["const"] == typename {
+				return cond["then"].(config.Schema).Property("Config")
+			}
+		}
+		return nil
+	}
+	handlers := s.Property("Handlers").Elements()
+
+	testhandler := typed(handlers, "testhandler")
+	if testhandler.Property("Reply")["type"] != "string" {
+		t.Fatalf("Bad testhandler schema: %v", testhandler)
+	}
+	proxy := typed(handlers, "ReverseProxy")
+	if proxy == nil {
+		t.Fatal("No ReverseProxy schema")
+	}
+	headers := typed(s.Property("HTTP").Elements().Property("Middleware")["items"].(config.Schema), "Headers")
+	if headers.Property("Response") == nil {
+		t.Fatalf("Bad Headers middleware schema: %v", headers)
+	}
+	module := typed(proxy.Property("Modules").Elements(), "set_header")
+	if module == nil {
+		t.Fatalf("No set_header module schema: %v", proxy.Property("Modules"))
+	}
 }
 
+func TestConfigHistory(t *testing.T) {
+	c := &configurator{cfgSpec: strings.NewReader(proxyConfig)}
+	history := &configHistory{size: 2}
+	cmd := &configCommand{history: history}
+
+	var cleanups []daemon.CleanupFunc
+	defer func() { runCleanups(cleanups) }()
+	for _, cfg := range []string{
+		proxyConfig,
+		strings.Replace(proxyConfig, `"Port" : 8180`, `"Port" : 8181`, 1),
+		strings.Replace(proxyConfig, `"Port" : 8180`, `"Port" : 8182`, 1),
+	} {
+		c.cfgSpec = strings.NewReader(cfg)
+		_, cl, loaded, _, err := c.configure()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cleanups = append(cleanups, cl...)
+		history.add(loaded)
+	}
+
+	invoke := func(args ...string) string {
+		var out strings.Builder
+		_, _, err := cmd.Invoke(context.Background(), &out, "config", args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+
+	lines := strings.Split(strings.TrimSpace(invoke("history")), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "3\t") || !strings.HasSuffix(lines[0], "(running)") ||
+		!strings.HasPrefix(lines[1], "2\t") {
+		t.Fatalf("Unexpected history: %q", lines)
+	}
+	if show := invoke("show"); !strings.Contains(show, "8182") {
+		t.Errorf("show doesn't show the running config: %s", show)
+	}
+	if diff := invoke("diff", "2"); diff != "~ HTTP.ProxyServer.Listeners.http.Port: 8181 -> 8182\n" {
+		t.Errorf("Unexpected diff: %q", diff)
+	}
+	for _, args := range [][]string{{"diff", "1"}, {"diff"}, {"show", "x"}, {"nosuchaction"}} {
+		if _, _, err := cmd.Invoke(context.Background(), io.Discard, "config", args); err == nil {
+			t.Errorf("Expected %q to fail", args)
+		}
+	}
+}
 
-func TestHandlerResolution(t *testing.T) {
-	done := make(chan struct{})
+func TestConfigProvider(t *testing.T) {
+	reply := "one"
+	provider := ConfigProvider(func() (*config.Config, error) {
+		return &config.Config{
+			HTTPServers: config.HTTPServersConfig{
+				"server": {
+					Listeners: map[string]config.ListenerConfig{"http": {Port: 8190}},
+					Handler:   &jconf.MandatorySubConfig{RawMessage: []byte(`"handler"`)},
+				},
+			},
+			Handlers: config.HandlersConfig{
+				"handler": {
+					Type:   "testhandler",
+					Config: &jconf.OptionalSubConfig{RawMessage: []byte(`{"Reply":"` + reply + `"}`)},
+				},
+			},
+		}, nil
+	})
+	c := &configurator{cfgSpec: provider}
 
-	go func() {
-		err := ozonemain(strings.NewReader(recursiveConfig))
+	var cleanups []daemon.CleanupFunc
+	defer func() { runCleanups(cleanups) }()
+	configure := func() reloadSummary {
+		_, cl, _, summary, err := c.configure()
 		if err != nil {
-			stdlog.Fatal(err)
+			t.Fatal(err)
 		}
-		close(done)
-	}()
+		cleanups = append(cleanups, cl...)
+		return summary
+	}
+
+	if summary := configure(); strings.Join(summary.Started, ",") != "server" {
+		t.Errorf("Expected server to start, got: %s", summary)
+	}
+	reply = "two"
+	if summary := configure(); strings.Join(summary.Restarted, ",") != "server" {
+		t.Errorf("Expected the provided config to be reloaded, got: %s", summary)
+	}
 
-	resp, err := http.Get("http://localhost:8180")
+	c.cfgSpec = ConfigProvider(func() (*config.Config, error) { return nil, nil })
+	if _, _, _, _, err := c.configure(); err == nil {
+		t.Error("Expected error for no config")
+	}
+}
+
+func TestConfigureHTTP2(t *testing.T) {
+	tc := &tls.Config{NextProtos: []string{"h2", "http/1.1"}}
+	srv := &http.Server{Handler: http.NotFoundHandler()}
+	_, err := configureHTTP2(&config.HTTP2Config{Disable: true}, srv, []*tls.Config{tc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.TLSNextProto == nil || strings.Join(tc.NextProtos, ",") != "http/1.1" {
+		t.Errorf("HTTP/2 not disabled: %v", tc.NextProtos)
+	}
+
+	tc = &tls.Config{}
+	srv = &http.Server{Handler: http.NotFoundHandler()}
+	_, err = configureHTTP2(&config.HTTP2Config{MaxConcurrentStreams: 10}, srv, []*tls.Config{tc})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.TLSNextProto["h2"] == nil || strings.Join(tc.NextProtos, ",") != "h2,http/1.1" {
+		t.Errorf("HTTP/2 not enabled: %v", tc.NextProtos)
+	}
+}
+
+func TestTLSPluginRegistryCopiesConfig(t *testing.T) {
+	plugins := config.TLSPluginsConfig{"custom": config.TLSPluginConfig{Plugin: "custom.so"}}
+	registry := newTLSPluginRegistry("", plugins, nil)
+	if _, ok := registry.cfg[""]; !ok {
+		t.Error("Default TLS plugin not added")
+	}
+	if _, ok := registry.cfg["custom"]; !ok {
+		t.Error("Configured TLS plugin missing")
+	}
+	if _, ok := plugins[""]; ok || len(plugins) != 1 {
+		t.Errorf("TLS plugin config modified: %v", plugins)
+	}
+}
+
+// TestUnixSocketOwnerOnly verifies that a socket file with a Mode is bound accessible only by the owner.
+func TestUnixSocketOwnerOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ozone.sock")
+	sock, err := newUnixSocket(config.ListenerConfig{Network: "unix", Path: path, Mode: "0666"})
 	if err != nil {
 		t.Fatal(err)
 	}
-	data, err := ioutil.ReadAll(resp.Body)
-	resp.Body.Close()
+	ls, err := sock.listen(daemon.ListenerSpec{Net: "unix", Addr: path})
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer ls[0].Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Socket file bound with mode %s", fi.Mode())
+	}
+}
+
+//----------------------------------------------------------------
+
+// counterSink records the value of a flushed counter.
+type counterSink struct{ value int64 }
 
-	if string(data) != "3" {
-		t.Error("No ok response")
+func (s *counterSink) Record(int, string, interface{}) {}
+func (s *counterSink) RecordNumeric64(mtype int, name string, value num64.Numeric64) {
+	s.value += value.Int64()
+}
+func (s *counterSink) Flush() {}
+
+func TestBodyLimit(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		handler http.HandlerFunc
+		status  int
+	}{
+		// The body is read by another goroutine - like the transport of a proxy.
+		{"handler responding", "0123456789a", func(w http.ResponseWriter, r *http.Request) {
+			done := make(chan error)
+			go func() {
+				_, err := io.Copy(ioutil.Discard, r.Body)
+				done <- err
+			}()
+			if err := <-done; err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+			}
+		}, http.StatusRequestEntityTooLarge},
+		{"handler not responding", "0123456789a", func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+		}, http.StatusRequestEntityTooLarge},
+		{"backend too large", "0123", func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}, http.StatusRequestEntityTooLarge},
+		{"small body", "0123456789", func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+		}, http.StatusOK},
 	}
 
-	shutdown(t)
-	<-done
+	rejected := metric.NewCounter("too-large")
+	for _, test := range tests {
+		h := limitRequestBody(test.handler, 10, "", rejected)
+		// Hide the length
+		r := httptest.NewRequest("POST", "/", io.MultiReader(strings.NewReader(test.body)))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: Expected %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+
+	// Only the requests rejected by the limit are counted.
+	var sink counterSink
+	rejected.FlushReading(&sink)
+	if sink.value != 2 {
+		t.Errorf("Expected 2 rejected requests counted, got %d", sink.value)
+	}
+}
+
+//----------------------------------------------------------------
+
+var redirectConfig = `{
+    "Code" : 301,
+    "Rules" : [
+        { "Host" : "(?P<sub>[a-z]+)\\.old\\.example", "Path" : "^/blog/([0-9]+)$", "URL" : "https://{sub}.example.com/posts/{1}{query}" },
+        { "Host" : "old\\.example", "URL" : "https://example.com{path}{query}", "Code" : 308 },
+        { "Path" : "^/insecure/", "URL" : "https://{hostname}:8443{path}" }
+    ]
+}`
+
+func TestRedirect(t *testing.T) {
+	h, err := makeRedirectHandler(&jconf.OptionalSubConfig{RawMessage: []byte(redirectConfig)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url      string
+		code     int
+		location string
+	}{
+		{"http://www.old.example/blog/42?ref=x", 301, "https://www.example.com/posts/42?ref=x"},
+		{"http://www.old.example/blog/new", 404, ""},
+		{"http://OLD.example:8080/a%20b/c?q=1", 308, "https://example.com/a%20b/c?q=1"},
+		{"http://example.com:8080/insecure/x", 301, "https://example.com:8443/insecure/x"},
+		{"http://example.com/other", 404, ""},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != test.code || w.Header().Get("Location") != test.location {
+			t.Errorf("%s: Expected %d %q, got %d %q", test.url, test.code, test.location, w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// A URL template without rules redirects everything.
+	h, err = makeRedirectHandler(&jconf.OptionalSubConfig{RawMessage: []byte(`{ "URL" : "https://{host}{path}{query}" }`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/x?y", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/x?y" {
+		t.Errorf("Bad upgrade redirect: %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	// Without rules a URL with other braces is fixed.
+	h, err = makeRedirectHandler(&jconf.OptionalSubConfig{RawMessage: []byte(`{ "URL" : "https://example.com/{id}" }`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/x", nil))
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "https://example.com/{id}" {
+		t.Errorf("Bad fixed redirect: %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	_, err = makeRedirectHandler(&jconf.OptionalSubConfig{RawMessage: []byte(`{
+        "URL" : "/{nosuch}",
+        "Rules" : [
+            { "Path" : "(", "URL" : "/" },
+            { "Path" : "^/(a)$", "URL" : "/{2}", "Code" : 200 }
+        ]
+    }`)})
+	errs, ok := err.(config.Errors)
+	if !ok {
+		t.Fatalf("Expected config.Errors, got %T: %v", err, err)
+	}
+	expected := []string{"URL", "Rules.0.Path", "Rules.1.Code"}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %s", len(expected), len(errs), err)
+	}
+	for i, e := range errs {
+		var pe *config.PathError
+		if !errors.As(e, &pe) {
+			t.Fatalf("Error not located by path: %s", e)
+		}
+		if path := strings.Join(pe.Path, "."); path != expected[i] {
+			t.Errorf("Expected error at %s, got %s", expected[i], path)
+		}
+	}
 }
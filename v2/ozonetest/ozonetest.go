@@ -0,0 +1,250 @@
+// Package ozonetest runs Ozone in the test process to test handlers and configs
+// against real listening servers.
+//
+// Configure listeners with port 0 to have the OS choose free ports and ask the
+// Daemon where the servers listen:
+//
+//	d := ozonetest.Start(t, config)
+//	resp, err := http.Get(d.URL("MyServer", "http") + "/path")
+//
+// Ozone is a process wide daemon, so only one Daemon can run at a time.
+package ozonetest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/One-com/gone/daemon/ctrl"
+	"github.com/One-com/gone/sd"
+
+	"github.com/One-com/ozone/v2"
+	"github.com/One-com/ozone/v2/config"
+)
+
+// Timeout is how long to wait for the daemon to start, reload and stop.
+var Timeout = 10 * time.Second
+
+var (
+	running sync.Mutex // held while a daemon runs
+	started int32      // daemons started - to name control sockets
+)
+
+// Daemon is Ozone running in the test process.
+type Daemon struct {
+	t      testing.TB
+	socket string // the control socket
+
+	mu     sync.Mutex
+	config string
+	addrs  map[string]map[string]net.Addr
+
+	ready chan struct{} // signaled when the servers are listening
+	done  chan error    // receives the error returned by Ozone when it has stopped
+
+	stopOnce sync.Once
+}
+
+// Start starts Ozone serving the JSON config and waits for the servers to listen.
+// Options are passed to Ozone for this daemon only, but the control socket is
+// chosen by Start.
+// The daemon is stopped when the test and its subtests complete.
+func Start(t testing.TB, cfg string, opts ...ozone.Option) *Daemon {
+	t.Helper()
+
+	if !running.TryLock() {
+		t.Fatal("ozonetest: An Ozone daemon is already running")
+	}
+
+	d := &Daemon{
+		t:      t,
+		socket: fmt.Sprintf("@ozonetest-%d-%d", os.Getpid(), atomic.AddInt32(&started, 1)),
+		config: cfg,
+		ready:  make(chan struct{}, 1),
+		done:   make(chan error, 1),
+	}
+
+	// The control socket of the daemon is served by each generation of servers, so a
+	// generation shutting down after a reload can accept a command and never answer it.
+	// Serving the control socket for the life of the Daemon instead makes commands
+	// right after a reload reliable.
+	// The listening socket is kept from the sd library, which the generations of servers
+	// inherit their sockets from.
+	control := &ctrl.Server{Addr: d.socket, ListenerFdName: d.socket, HelpCommand: "?", QuitCommand: "q"}
+	if err := control.Listen(); err != nil {
+		running.Unlock()
+		t.Fatalf("ozonetest: Failed to listen on control socket: %v", err)
+	}
+	sd.Forget(d.socket)
+	go control.Serve()
+
+	opts = append(opts, ozone.ControlSocket(""), ozone.ReadyCallback(d.onReady))
+	go func() {
+		err := ozone.MainWithConfigProvider(d.provideConfig, opts...)
+		control.Shutdown()
+		d.done <- err
+		running.Unlock()
+	}()
+
+	select {
+	case <-d.ready:
+	case err := <-d.done:
+		t.Fatalf("ozonetest: Ozone failed to start: %v", err)
+	case <-time.After(Timeout):
+		t.Fatal("ozonetest: Timeout waiting for Ozone to start")
+	}
+
+	t.Cleanup(d.Stop)
+	return d
+}
+
+// provideConfig parses the current config on start and reload.
+func (d *Daemon) provideConfig() (*config.Config, error) {
+	d.mu.Lock()
+	cfg := d.config
+	d.mu.Unlock()
+	return config.ParseConfigFromReadSeeker(strings.NewReader(cfg))
+}
+
+// onReady records the listener addresses when the servers are listening.
+func (d *Daemon) onReady() {
+	d.mu.Lock()
+	d.addrs = ozone.ListenerAddrs()
+	d.mu.Unlock()
+	select {
+	case d.ready <- struct{}{}:
+	default:
+	}
+}
+
+// listenerAddr returns the address the listener of the server is bound to.
+func (d *Daemon) listenerAddr(server, listener string) net.Addr {
+	d.t.Helper()
+	d.mu.Lock()
+	addr := d.addrs[server][listener]
+	d.mu.Unlock()
+	if addr == nil {
+		d.t.Fatalf("ozonetest: No listener %s for server %s", listener, server)
+	}
+	return addr
+}
+
+// Addr returns the address the listener of the server is bound to - with a
+// dialable host if listening on all interfaces. For UNIX socket listeners it's
+// the socket path.
+func (d *Daemon) Addr(server, listener string) string {
+	d.t.Helper()
+	addr := d.listenerAddr(server, listener)
+
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+	host := tcpaddr.IP.String()
+	if tcpaddr.IP == nil || tcpaddr.IP.IsUnspecified() {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, fmt.Sprint(tcpaddr.Port))
+}
+
+// URL returns the "http://" URL of the listener of the server.
+// UNIX socket listeners have no URL of their own, so they get "http://localhost",
+// which must be requested using Client.
+func (d *Daemon) URL(server, listener string) string {
+	d.t.Helper()
+	if _, ok := d.listenerAddr(server, listener).(*net.UnixAddr); ok {
+		return "http://localhost"
+	}
+	return "http://" + d.Addr(server, listener)
+}
+
+// Client returns a HTTP client connecting to the listener of the server
+// whatever the URL requested - to make requests to UNIX socket listeners.
+func (d *Daemon) Client(server, listener string) *http.Client {
+	d.t.Helper()
+	addr := d.listenerAddr(server, listener)
+	network, address := addr.Network(), d.Addr(server, listener)
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}}
+}
+
+// Control runs a control socket command (like "daemon reload") and returns its output.
+func (d *Daemon) Control(args ...string) string {
+	d.t.Helper()
+	out, err := d.control(args...)
+	if err != nil {
+		d.t.Fatalf("ozonetest: Control command %q failed: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+func (d *Daemon) control(args ...string) (string, error) {
+	conn, err := net.DialTimeout("unix", d.socket, Timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(Timeout))
+
+	// "!" makes the control socket close the connection when the command is done.
+	_, err = fmt.Fprintf(conn, "! %s\n", strings.Join(args, " "))
+	if err != nil {
+		return "", err
+	}
+	out, err := io.ReadAll(conn)
+	return string(out), err
+}
+
+// Reload makes Ozone reload with a new config and returns the output of the
+// "daemon reload" control command. If the config was loaded, Reload waits for
+// the servers to listen.
+func (d *Daemon) Reload(cfg string) string {
+	d.t.Helper()
+	d.mu.Lock()
+	d.config = cfg
+	d.mu.Unlock()
+
+	select {
+	case <-d.ready:
+	default:
+	}
+	out := d.Control("daemon", "reload")
+	if strings.HasPrefix(out, "OK") {
+		select {
+		case <-d.ready:
+		case <-time.After(Timeout):
+			d.t.Fatal("ozonetest: Timeout waiting for Ozone to reload")
+		}
+	}
+	return out
+}
+
+// Stop stops Ozone gracefully and waits for it to exit.
+// It's called when the test completes, but can be called before.
+func (d *Daemon) Stop() {
+	d.t.Helper()
+	d.stopOnce.Do(func() {
+		// The exiting daemon may close the connection before the command is done.
+		// A daemon already stopping may not answer at all, so don't wait for it.
+		go d.control("daemon", "stop")
+		select {
+		case err := <-d.done:
+			if err != nil {
+				d.t.Errorf("ozonetest: Ozone exited with error: %v", err)
+			}
+		case <-time.After(Timeout):
+			d.t.Error("ozonetest: Timeout waiting for Ozone to stop")
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package ozonetest_test
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/One-com/ozone/v2"
+	"github.com/One-com/ozone/v2/ozonetest"
+)
+
+var redirectConfig = `{
+    "HTTP" : {
+        "Main" : {
+            "Listeners" : {
+                "http" : {
+                    "Address" : "127.0.0.1",
+                    "Port" : 0
+                },
+                "unix" : {
+                    "Network" : "unix",
+                    "Path" : "%s"
+                }
+            },
+            "Handler" : "redirect"
+        }
+    },
+    "Handlers" : {
+        "redirect" : {
+            "Type" : "Redirect",
+            "Config" : {
+                "URL" : "https://example.com/",
+                "Code" : %d
+            }
+        }
+    }
+}
+`
+
+// redirectCode requests the listener without following the redirect.
+func redirectCode(t *testing.T, d *ozonetest.Daemon, listener string) int {
+	t.Helper()
+	client := d.Client("Main", listener)
+	client.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := client.Get(d.URL("Main", listener))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestDaemon(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "ozone.sock")
+
+	d := ozonetest.Start(t, fmt.Sprintf(redirectConfig, socket, 301), ozone.DrainDelay(time.Second))
+	if !strings.HasPrefix(d.URL("Main", "http"), "http://127.0.0.1:") {
+		t.Errorf("Bad URL: %s", d.URL("Main", "http"))
+	}
+	if d.Addr("Main", "unix") != socket {
+		t.Errorf("Bad UNIX socket address: %s", d.Addr("Main", "unix"))
+	}
+	for _, listener := range []string{"http", "unix"} {
+		if code := redirectCode(t, d, listener); code != 301 {
+			t.Errorf("Bad code from %s listener: %d", listener, code)
+		}
+	}
+
+	if out := d.Reload(fmt.Sprintf(redirectConfig, socket, 308)); !strings.HasPrefix(out, "OK") {
+		t.Fatalf("Reload failed: %q", out)
+	}
+	for _, listener := range []string{"http", "unix"} {
+		if code := redirectCode(t, d, listener); code != 308 {
+			t.Errorf("Bad code from %s listener after reload: %d", listener, code)
+		}
+	}
+
+	if out := d.Reload(`{ "HTTP" : { "Main" : { "Handler" : "nosuchhandler" } } }`); !strings.Contains(out, "Reload failed") {
+		t.Errorf("Bad config reloaded: %q", out)
+	}
+	if code := redirectCode(t, d, "http"); code != 308 {
+		t.Errorf("Bad code after failed reload: %d", code)
+	}
+}
+
+// TestOptions verifies that options only apply to the daemon they are given to -
+// like the DrainDelay of TestDaemon.
+func TestOptions(t *testing.T) {
+	start := time.Now()
+	ozonetest.Start(t, fmt.Sprintf(redirectConfig, filepath.Join(t.TempDir(), "ozone.sock"), 301)).Stop()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Drain delay of earlier daemon used: Stopping took %s", elapsed)
+	}
+}
@@ -2,9 +2,11 @@ package ozone
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/One-com/gone/daemon"
@@ -27,13 +29,14 @@ func (p *procCommand) ShortUsage() (syntax, comment string) {
 
 func (p *procCommand) Usage(cmd string, w io.Writer) {
 	fmt.Fprintln(w, cmd, "control the process")
+	fmt.Fprintln(w, cmd, "reload waits for the new servers to serve and writes \"OK\" and the servers started and stopped - or the errors")
 }
 
 func (p *procCommand) Invoke(ctx context.Context, w io.Writer, cmd string, args []string) (async func(), persistent string, err error) {
 	cmd = args[0]
 	switch cmd {
 	case "reload":
-		onSignalReload()
+		err = reload(ctx, w)
 	case "kill":
 		onSignalExit()
 	case "stop":
@@ -48,7 +51,9 @@ func (p *procCommand) Invoke(ctx context.Context, w io.Writer, cmd string, args
 		}
 		log.Printf("Graceful Exit - timeout: %s", timeout.String())
 		sd.Notify(0, "STOPPING=1")
-		daemon.ExitGracefulWithTimeout(timeout)
+		daemonState.drain(cfg.draindelay, func() {
+			daemon.ExitGracefulWithTimeout(timeout)
+		})
 	case "respawn":
 		onSignalRespawn()
 	default:
@@ -56,3 +61,39 @@ func (p *procCommand) Invoke(ctx context.Context, w io.Writer, cmd string, args
 	}
 	return
 }
+
+// reload reloads the config and writes the result to w.
+// The first line is "OK" if the new config is serving, followed by a summary of changed servers.
+// Otherwise the errors are written one per line and an error is returned.
+func reload(ctx context.Context, w io.Writer) error {
+	result := reloads.wait()
+	defer reloads.cancel(result)
+
+	onSignalReload()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case r := <-result:
+		if r.err != nil {
+			writeConfigErrors(w, r.err)
+			return errors.New("Reload failed")
+		}
+		fmt.Fprintln(w, "OK")
+		s := r.summary
+		for _, l := range []struct {
+			what  string
+			names []string
+		}{
+			{"Started", s.Started},
+			{"Restarted", s.Restarted},
+			{"Stopped", s.Stopped},
+			{"Kept", s.Kept},
+		} {
+			if len(l.names) != 0 {
+				fmt.Fprintf(w, "%s: %s\n", l.what, strings.Join(l.names, ", "))
+			}
+		}
+	}
+	return nil
+}
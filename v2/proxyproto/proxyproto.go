@@ -0,0 +1,300 @@
+// Package proxyproto provides a net.Listener wrapper reading the PROXY protocol (v1 and v2) header
+// sent by TCP load balancers (like HAProxy or AWS NLB) to learn the real client address.
+// See https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+//
+// The header is read when the connection is first read or asked for its address - not by Accept,
+// so a slow client can't hold up accepting other connections.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/One-com/gone/jconf"
+)
+
+// Modes of PROXY protocol support.
+const (
+	ModeOff      = "off"      // don't read headers
+	ModeOptional = "optional" // read a header if the connection starts with one
+	ModeRequired = "required" // close connections without a header
+)
+
+// DefaultTimeout is the default time allowed to receive the header.
+const DefaultTimeout = 10 * time.Second
+
+// Config is the JSON config of PROXY protocol support on a listener.
+type Config struct {
+	Mode    string         // "off" (the default), "optional" or "required"
+	Trusted []string       `json:",omitempty"` // CIDRs of load balancers allowed to send headers. Default any.
+	Timeout jconf.Duration `json:",omitempty"` // to receive the header
+}
+
+var (
+	// ErrNoHeader is returned reading a connection with no header when a header is required.
+	ErrNoHeader = errors.New("PROXY protocol header missing")
+	// ErrBadHeader is returned reading a connection with an invalid header.
+	ErrBadHeader = errors.New("Invalid PROXY protocol header")
+)
+
+var (
+	v1Prefix    = []byte("PROXY ")
+	v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+const v1MaxLength = 107
+
+// Listener wraps a net.Listener reading the PROXY protocol header of accepted connections.
+type Listener struct {
+	net.Listener
+	Required bool         // close connections without a header
+	Trusted  []*net.IPNet // only read headers from these sources - if any
+	Timeout  time.Duration
+}
+
+// NewListener makes a Listener from the config. A nil Listener is returned if the mode is off.
+func NewListener(cfg *Config) (l *Listener, err error) {
+	if cfg == nil {
+		return
+	}
+	l = &Listener{Timeout: cfg.Timeout.Duration}
+	switch cfg.Mode {
+	case "", ModeOff:
+		return nil, nil
+	case ModeOptional:
+	case ModeRequired:
+		l.Required = true
+	default:
+		return nil, fmt.Errorf("Unknown PROXY protocol mode: %s", cfg.Mode)
+	}
+	for _, cidr := range cfg.Trusted {
+		var n *net.IPNet
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid trusted address: %s", cidr)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			n = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if _, n, err = net.ParseCIDR(cidr); err != nil {
+			return nil, err
+		}
+		l.Trusted = append(l.Trusted, n)
+	}
+	return
+}
+
+// Wrap returns a copy of the Listener wrapping inner.
+func (l *Listener) Wrap(inner net.Listener) net.Listener {
+	wrapped := *l
+	wrapped.Listener = inner
+	return &wrapped
+}
+
+// Accept returns the next connection - without reading its header yet.
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if !l.trusted(c.RemoteAddr()) {
+		if l.Required {
+			// Only trusted sources can supply the required header.
+			c.Close()
+			return &failedConn{Conn: c, err: ErrNoHeader}, nil
+		}
+		return c, nil
+	}
+	timeout := l.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &Conn{Conn: c, reader: bufio.NewReader(c), required: l.Required, timeout: timeout}, nil
+}
+
+// trusted tells whether the source is allowed to send a header.
+// Connections on UNIX sockets are local and trusted.
+func (l *Listener) trusted(addr net.Addr) bool {
+	if len(l.Trusted) == 0 {
+		return true
+	}
+	tcpaddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	for _, n := range l.Trusted {
+		if n.Contains(tcpaddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// failedConn is an accepted connection which is refused. Returning an error from Accept
+// would make the HTTP server stop accepting.
+type failedConn struct {
+	net.Conn
+	err error
+}
+
+func (c *failedConn) Read(b []byte) (int, error) {
+	return 0, c.err
+}
+
+// Conn is a connection which reads any PROXY protocol header before the first data is read.
+type Conn struct {
+	net.Conn
+	reader   *bufio.Reader
+	required bool
+	timeout  time.Duration
+
+	once       sync.Once
+	err        error
+	remoteAddr net.Addr // from the header - if any
+	localAddr  net.Addr
+}
+
+// Read reads data following the header.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.once.Do(c.readHeader)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address given by the header - or the address of the peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to given by the header - or the local address.
+func (c *Conn) LocalAddr() net.Addr {
+	c.once.Do(c.readHeader)
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readHeader reads and parses any header. On error the connection is closed.
+func (c *Conn) readHeader() {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	c.remoteAddr, c.localAddr, c.err = readHeader(c.reader, c.required)
+	if c.err != nil {
+		c.Conn.Close()
+		return
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+}
+
+// readHeader reads any header from r, returning the addresses it carries.
+// Headers not carrying addresses (v1 UNKNOWN or v2 LOCAL) return nil addresses.
+func readHeader(r *bufio.Reader, required bool) (src, dst net.Addr, err error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	switch first[0] {
+	case v1Prefix[0]:
+		if p, e := r.Peek(len(v1Prefix)); e == nil && bytes.Equal(p, v1Prefix) {
+			return readV1(r)
+		}
+	case v2Signature[0]:
+		if p, e := r.Peek(len(v2Signature)); e == nil && bytes.Equal(p, v2Signature) {
+			return readV2(r)
+		}
+	}
+	if required {
+		err = ErrNoHeader
+	}
+	return
+}
+
+// readV1 reads a text header: "PROXY TCP4 <src ip> <dst ip> <src port> <dst port>\r\n"
+func readV1(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var line []byte
+	for len(line) < v1MaxLength {
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			return
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, ErrBadHeader
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, ErrBadHeader
+	}
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	srcPort, e1 := strconv.ParseUint(fields[4], 10, 16)
+	dstPort, e2 := strconv.ParseUint(fields[5], 10, 16)
+	if srcIP == nil || dstIP == nil || e1 != nil || e2 != nil {
+		return nil, nil, ErrBadHeader
+	}
+	src = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	dst = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return
+}
+
+// readV2 reads a binary header.
+func readV2(r *bufio.Reader) (src, dst net.Addr, err error) {
+	var hdr [16]byte
+	if _, err = io.ReadFull(r, hdr[:]); err != nil {
+		return
+	}
+	version, command := hdr[12]>>4, hdr[12]&0xf
+	family, transport := hdr[13]>>4, hdr[13]&0xf
+	length := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if version != 2 || command > 1 {
+		return nil, nil, ErrBadHeader
+	}
+
+	payload := make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return
+	}
+	if command == 0 || transport != 1 {
+		// LOCAL (health checks by the proxy) or not TCP: Keep the connection addresses.
+		return
+	}
+	switch family {
+	case 1: // IPv4
+		if length < 12 {
+			return nil, nil, ErrBadHeader
+		}
+		src = &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}
+		dst = &net.TCPAddr{IP: net.IP(payload[4:8]), Port: int(binary.BigEndian.Uint16(payload[10:12]))}
+	case 2: // IPv6
+		if length < 36 {
+			return nil, nil, ErrBadHeader
+		}
+		src = &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}
+		dst = &net.TCPAddr{IP: net.IP(payload[16:32]), Port: int(binary.BigEndian.Uint16(payload[34:36]))}
+	}
+	return
+}
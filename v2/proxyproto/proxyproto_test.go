@@ -0,0 +1,98 @@
+package proxyproto
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func v2Header(command byte, src, dst *net.TCPAddr) []byte {
+	hdr := append([]byte{}, v2Signature...)
+	hdr = append(hdr, 0x20|command, 0x11, 0, 12)
+	hdr = append(hdr, src.IP.To4()...)
+	hdr = append(hdr, dst.IP.To4()...)
+	var ports [4]byte
+	binary.BigEndian.PutUint16(ports[0:2], uint16(src.Port))
+	binary.BigEndian.PutUint16(ports[2:4], uint16(dst.Port))
+	return append(hdr, ports[:]...)
+}
+
+func TestListener(t *testing.T) {
+	client := &net.TCPAddr{IP: net.ParseIP("192.0.2.1").To4(), Port: 56324}
+	server := &net.TCPAddr{IP: net.ParseIP("198.51.100.1").To4(), Port: 443}
+
+	tests := []struct {
+		name   string
+		cfg    Config
+		send   string
+		remote string // expected RemoteAddr - "" for the peer address
+		data   string // expected data - "" for a closed connection
+	}{
+		{"v1", Config{Mode: ModeOptional}, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET", "192.0.2.1:56324", "GET"},
+		{"v1 unknown", Config{Mode: ModeRequired}, "PROXY UNKNOWN\r\nGET", "", "GET"},
+		{"v1 bad", Config{Mode: ModeOptional}, "PROXY TCP4 192.0.2.1\r\nGET", "", ""},
+		{"v2", Config{Mode: ModeRequired}, string(v2Header(1, client, server)) + "GET", "192.0.2.1:56324", "GET"},
+		{"v2 local", Config{Mode: ModeRequired}, string(v2Header(0, client, server)) + "GET", "", "GET"},
+		{"optional", Config{Mode: ModeOptional}, "GET", "", "GET"},
+		{"required", Config{Mode: ModeRequired}, "GET", "", ""},
+		{"trusted", Config{Mode: ModeRequired, Trusted: []string{"127.0.0.0/8"}}, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET", "192.0.2.1:56324", "GET"},
+		{"untrusted", Config{Mode: ModeOptional, Trusted: []string{"10.0.0.1"}}, "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET", "", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\nGET"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pl, err := NewListener(&test.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			inner, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			l := pl.Wrap(inner)
+			defer l.Close()
+
+			go func() {
+				c, err := net.Dial("tcp", inner.Addr().String())
+				if err != nil {
+					return
+				}
+				c.Write([]byte(test.send))
+				c.(*net.TCPConn).CloseWrite()
+				io.Copy(io.Discard, c)
+				c.Close()
+			}()
+
+			c, err := l.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			remote := c.RemoteAddr().String()
+			data, _ := io.ReadAll(c)
+			if string(data) != test.data {
+				t.Errorf("Expected data %q, got %q", test.data, data)
+			}
+			if test.remote != "" && remote != test.remote {
+				t.Errorf("Expected remote address %s, got %s", test.remote, remote)
+			}
+			if test.remote == "" && test.data != "" && remote == client.String() {
+				t.Errorf("Unexpected remote address from header")
+			}
+		})
+	}
+}
+
+func TestNewListener(t *testing.T) {
+	if l, err := NewListener(&Config{Mode: ModeOff}); l != nil || err != nil {
+		t.Errorf("Expected no listener for mode off: %v %v", l, err)
+	}
+	if _, err := NewListener(&Config{Mode: "sometimes"}); err == nil {
+		t.Error("Expected error for unknown mode")
+	}
+	if _, err := NewListener(&Config{Mode: ModeRequired, Trusted: []string{"10.0.0.0/33"}}); err == nil {
+		t.Error("Expected error for bad CIDR")
+	}
+}
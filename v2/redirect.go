@@ -0,0 +1,251 @@
+package ozone
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/One-com/gone/jconf"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// templateVar matches the variables of redirect URL templates.
+var templateVar = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// Variables of redirect URL templates given by the request.
+var requestVars = map[string]func(r *http.Request) string{
+	"scheme": func(r *http.Request) string {
+		if r.TLS != nil {
+			return "https"
+		}
+		return "http"
+	},
+	"host": func(r *http.Request) string { return r.Host },
+	"hostname": func(r *http.Request) string {
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			return host
+		}
+		return r.Host
+	},
+	"path": func(r *http.Request) string { return r.URL.EscapedPath() },
+	"query": func(r *http.Request) string {
+		if r.URL.RawQuery == "" {
+			return ""
+		}
+		return "?" + r.URL.RawQuery
+	},
+}
+
+// redirectTemplate is a parsed redirect URL. Even parts are literal text and odd parts are variables.
+type redirectTemplate []string
+
+// parseRedirectTemplate parses a URL template. Variables must be request variables or in captures.
+func parseRedirectTemplate(tmpl string, captures map[string]bool) (redirectTemplate, error) {
+	var t redirectTemplate
+	last := 0
+	for _, m := range templateVar.FindAllStringSubmatchIndex(tmpl, -1) {
+		name := tmpl[m[2]:m[3]]
+		if _, ok := requestVars[name]; !ok && !captures[name] {
+			return nil, fmt.Errorf("Unknown variable {%s} in URL", name)
+		}
+		t = append(t, tmpl[last:m[0]], name)
+		last = m[1]
+	}
+	return append(t, tmpl[last:]), nil
+}
+
+// hasRequestVars tells whether a URL is a template - having only variables given by the request.
+func hasRequestVars(tmpl string) bool {
+	vars := templateVar.FindAllStringSubmatch(tmpl, -1)
+	for _, m := range vars {
+		if _, ok := requestVars[m[1]]; !ok {
+			return false
+		}
+	}
+	return len(vars) != 0
+}
+
+// expand makes the URL for a request with the captured groups of the rule matching it.
+func (t redirectTemplate) expand(r *http.Request, captured map[string]string) string {
+	var b strings.Builder
+	for i, part := range t {
+		if i%2 == 0 {
+			b.WriteString(part)
+		} else if value, ok := captured[part]; ok {
+			b.WriteString(value)
+		} else {
+			b.WriteString(requestVars[part](r))
+		}
+	}
+	return b.String()
+}
+
+// redirectRule is a configured RedirectRuleConfig.
+type redirectRule struct {
+	host *regexp.Regexp
+	path *regexp.Regexp
+	url  redirectTemplate
+	code int
+}
+
+// match tells whether a request matches the rule - returning the groups captured.
+func (rule *redirectRule) match(r *http.Request) (captured map[string]string, ok bool) {
+	captured = make(map[string]string)
+	if rule.host != nil {
+		m := rule.host.FindStringSubmatch(requestVars["hostname"](r))
+		if m == nil {
+			return nil, false
+		}
+		addCaptures(captured, rule.host, m, false)
+	}
+	if rule.path != nil {
+		m := rule.path.FindStringSubmatch(r.URL.EscapedPath())
+		if m == nil {
+			return nil, false
+		}
+		addCaptures(captured, rule.path, m, true)
+	}
+	return captured, true
+}
+
+// addCaptures adds the named groups of a match - and the numbered if numbered is true.
+func addCaptures(captured map[string]string, re *regexp.Regexp, m []string, numbered bool) {
+	for i, name := range re.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		if numbered {
+			captured[strconv.Itoa(i)] = m[i]
+		}
+		if name != "" {
+			captured[name] = m[i]
+		}
+	}
+}
+
+// captureNames returns the names of the groups of the regular expressions usable in templates.
+func captureNames(host, path *regexp.Regexp) map[string]bool {
+	names := make(map[string]bool)
+	for _, re := range []*regexp.Regexp{host, path} {
+		if re == nil {
+			continue
+		}
+		for i, name := range re.SubexpNames() {
+			if i != 0 && re == path {
+				names[strconv.Itoa(i)] = true
+			}
+			if name != "" {
+				names[name] = true
+			}
+		}
+	}
+	return names
+}
+
+// redirectHandler redirects by the first rule matching - or to the default URL.
+type redirectHandler struct {
+	rules []*redirectRule
+	url   redirectTemplate // nil for 404
+	code  int
+}
+
+func (h *redirectHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, rule := range h.rules {
+		if captured, ok := rule.match(r); ok {
+			http.Redirect(w, r, rule.url.expand(r, captured), rule.code)
+			return
+		}
+	}
+	if h.url == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.Redirect(w, r, h.url.expand(r, nil), h.code)
+}
+
+func checkRedirectCode(code int) error {
+	if code < 300 || code > 399 {
+		return fmt.Errorf("Invalid redirect code: %d", code)
+	}
+	return nil
+}
+
+// makeRedirectHandler makes a "Redirect" handler. Errors are located relative to the handler config.
+func makeRedirectHandler(js jconf.SubConfig) (handler http.Handler, err error) {
+	cfg := new(config.RedirectHandlerConfig)
+	err = js.ParseInto(&cfg)
+	if err != nil {
+		return
+	}
+
+	if cfg.Code == 0 {
+		cfg.Code = http.StatusFound
+	}
+	if err = checkRedirectCode(cfg.Code); err != nil {
+		err = config.AtPath(err, "Code")
+		return
+	}
+
+	// A fixed URL is redirected to like always - also if it has braces not naming request variables.
+	if len(cfg.Rules) == 0 && cfg.URL != "" && !hasRequestVars(cfg.URL) {
+		handler = http.RedirectHandler(cfg.URL, cfg.Code)
+		return
+	}
+	if len(cfg.Rules) == 0 && cfg.URL == "" {
+		err = errors.New("Redirect needs a URL or Rules")
+		return
+	}
+
+	h := &redirectHandler{code: cfg.Code}
+	var errs config.Errors
+	if cfg.URL != "" {
+		h.url, err = parseRedirectTemplate(cfg.URL, nil)
+		errs.Add(config.AtPath(err, "URL"))
+	}
+	for i, rcfg := range cfg.Rules {
+		rule, e := makeRedirectRule(&rcfg, cfg.Code)
+		if e != nil {
+			errs.Add(config.AtPath(e, "Rules", strconv.Itoa(i)))
+			continue
+		}
+		h.rules = append(h.rules, rule)
+	}
+	if err = errs.Err(); err != nil {
+		return
+	}
+	handler = h
+	return
+}
+
+// makeRedirectRule configures a rule. Errors are located relative to the rule config.
+func makeRedirectRule(cfg *config.RedirectRuleConfig, code int) (rule *redirectRule, err error) {
+	rule = &redirectRule{code: cfg.Code}
+	if rule.code == 0 {
+		rule.code = code
+	}
+	var errs config.Errors
+	errs.Add(config.AtPath(checkRedirectCode(rule.code), "Code"))
+	if cfg.Host != "" {
+		rule.host, err = regexp.Compile("(?i)^(?:" + cfg.Host + ")$")
+		errs.Add(config.AtPath(err, "Host"))
+	}
+	if cfg.Path != "" {
+		rule.path, err = regexp.Compile(cfg.Path)
+		errs.Add(config.AtPath(err, "Path"))
+	}
+	if cfg.URL == "" {
+		errs.Add(config.AtPath(errors.New("Missing URL"), "URL"))
+	} else if len(errs) == 0 {
+		rule.url, err = parseRedirectTemplate(cfg.URL, captureNames(rule.host, rule.path))
+		errs.Add(config.AtPath(err, "URL"))
+	}
+	if err = errs.Err(); err != nil {
+		return nil, err
+	}
+	return
+}
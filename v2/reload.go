@@ -0,0 +1,428 @@
+package ozone
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/One-com/gone/daemon"
+	"github.com/One-com/gone/jconf"
+	"github.com/One-com/gone/log"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// A reload doesn't start from scratch. Handlers and the handler chains of servers
+// (access logging and metrics) are kept as components across reloads as long as
+// their config is unchanged and everything they depend on is kept.
+// This keeps proxy upstream state (quarantines, pins), health checkers and open access
+// logs alive across reloads.
+// The http.Server objects themselves are always recreated (with the same listening sockets)
+// around the kept handler chains to pick up changed listeners and TLS certificates.
+
+// component is a handler or the handler chain of a server.
+type component struct {
+	fingerprint string   // the config it was built from
+	deps        []string // names of the handlers resolved while building it
+	handler     http.Handler
+	service     *persistentService
+	cleanups    []daemon.CleanupFunc
+	config      *jconf.OptionalSubConfig // the handler config it parsed - to dump the config of kept handlers
+
+	refs int // generations using the component. Guarded by componentsLock
+}
+
+// componentsLock guards the reference counts of components shared by generations.
+var componentsLock sync.Mutex
+
+// release stops the component service and runs its cleanups.
+func (c *component) release() {
+	if c.service != nil {
+		c.service.stop()
+	}
+	runCleanups(c.cleanups)
+}
+
+// generation is the set of components built (or kept) for one configuration of the daemon.
+type generation struct {
+	prev     *generation // the running generation to keep components from - if any
+	handlers map[string]*component
+	servers  map[string]*component
+}
+
+func newGeneration(prev *generation) *generation {
+	return &generation{
+		prev:     prev,
+		handlers: make(map[string]*component),
+		servers:  make(map[string]*component),
+	}
+}
+
+// previousHandler returns the handler component of the previous generation if
+// it was built from the same config.
+func (g *generation) previousHandler(name, fingerprint string) *component {
+	if g.prev == nil {
+		return nil
+	}
+	if c := g.prev.handlers[name]; c != nil && c.fingerprint == fingerprint {
+		return c
+	}
+	return nil
+}
+
+// previousServer returns the server handler chain of the previous generation if
+// it was built from the same config.
+func (g *generation) previousServer(name, fingerprint string) *component {
+	if g.prev == nil {
+		return nil
+	}
+	if c := g.prev.servers[name]; c != nil && c.fingerprint == fingerprint {
+		return c
+	}
+	return nil
+}
+
+// components returns all components of the generation.
+func (g *generation) components() (comps []*component) {
+	for _, c := range g.handlers {
+		comps = append(comps, c)
+	}
+	for _, c := range g.servers {
+		comps = append(comps, c)
+	}
+	return
+}
+
+// kept tells whether c is taken over from the previous generation.
+func (g *generation) kept(c *component) bool {
+	if g.prev == nil {
+		return false
+	}
+	for _, p := range g.prev.components() {
+		if p == c {
+			return true
+		}
+	}
+	return false
+}
+
+// discard releases the components built for a generation which will never run.
+// Components kept from the previous generation are left to it.
+func (g *generation) discard() {
+	for _, c := range g.components() {
+		if !g.kept(c) {
+			c.release()
+		}
+	}
+}
+
+// acquire marks the components as in use by the generation - to be released by the
+// generation cleanup when it has shut down.
+func (g *generation) acquire() {
+	componentsLock.Lock()
+	defer componentsLock.Unlock()
+	for _, c := range g.components() {
+		c.refs++
+	}
+}
+
+// release is the cleanup of a generation. Components not used by any other generation
+// are released.
+func (g *generation) release() error {
+	componentsLock.Lock()
+	defer componentsLock.Unlock()
+	for _, c := range g.components() {
+		c.refs--
+		if c.refs == 0 {
+			c.release()
+		}
+	}
+	return nil
+}
+
+// reloadSummary describes how a generation differs from the previous.
+type reloadSummary struct {
+	Started   []string // new servers
+	Restarted []string // servers with changed config or handlers
+	Kept      []string // servers with unchanged handler chains
+	Stopped   []string // servers no longer configured
+	Handlers  []string // handlers (re)built
+}
+
+// summary compares the generation with the previous.
+func (g *generation) summary() (s reloadSummary) {
+	var prev *generation
+	if g.prev != nil {
+		prev = g.prev
+	} else {
+		prev = newGeneration(nil)
+	}
+	for name, c := range g.servers {
+		switch p, ok := prev.servers[name]; {
+		case !ok:
+			s.Started = append(s.Started, name)
+		case p != c:
+			s.Restarted = append(s.Restarted, name)
+		default:
+			s.Kept = append(s.Kept, name)
+		}
+	}
+	for name := range prev.servers {
+		if _, ok := g.servers[name]; !ok {
+			s.Stopped = append(s.Stopped, name)
+		}
+	}
+	for name, c := range g.handlers {
+		if prev.handlers[name] != c {
+			s.Handlers = append(s.Handlers, name)
+		}
+	}
+	for _, l := range [][]string{s.Started, s.Restarted, s.Kept, s.Stopped, s.Handlers} {
+		sort.Strings(l)
+	}
+	return
+}
+
+func (s reloadSummary) String() string {
+	var parts []string
+	add := func(what string, names []string) {
+		if len(names) != 0 {
+			parts = append(parts, fmt.Sprintf("%s: %s", what, strings.Join(names, ", ")))
+		}
+	}
+	add("started", s.Started)
+	add("restarted", s.Restarted)
+	add("kept", s.Kept)
+	add("stopped", s.Stopped)
+	add("handlers built", s.Handlers)
+	return strings.Join(parts, "; ")
+}
+
+// configurator configures new generations of servers from the config, keeping
+// what it can from the running generation.
+type configurator struct {
+	cfgSpec interface{}
+	running *generation
+}
+
+// configure instantiates the servers of a new generation from the config.
+// The returned cleanups release the generation when it has been shut down.
+func (c *configurator) configure() (servers []daemon.Server, cleanups []daemon.CleanupFunc, cfg *config.Config, summary reloadSummary, err error) {
+
+	gen := newGeneration(c.running)
+	servers, cleanups, cfg, err = instantiateServersFromConfig(c.cfgSpec, false, gen)
+	if err != nil {
+		return
+	}
+
+	summary = gen.summary()
+	gen.prev = nil // don't keep the history alive.
+	gen.acquire()
+	cleanups = append(cleanups, gen.release)
+	c.running = gen
+	return
+}
+
+// handlerFingerprint identifies the config of a handler - including the files the handler type
+// declares reading, so handlers reading certificates or other files are rebuilt when the files change.
+func handlerFingerprint(cfg *config.HandlerConfig) string {
+	var raw []byte
+	var files string
+	if cfg.Config != nil {
+		raw = compactJSON(cfg.Config.RawMessage)
+		if f := handlerFiles[cfg.Type]; f != nil {
+			// Parse a copy, not to set the parsed config of the handler.
+			files = filesFingerprint(f(&jconf.OptionalSubConfig{RawMessage: cfg.Config.RawMessage}))
+		}
+	}
+	limit := strconv.FormatInt(cfg.MaxRequestBody, 10)
+	return strings.Join([]string{cfg.Type, cfg.Plugin, cfg.Metrics, limit, cfg.MaxRequestBodyError, middlewareFingerprint(cfg.Middleware), string(raw), files}, "\x00")
+}
+
+// filesFingerprint identifies the size and modification time of files.
+func filesFingerprint(files []string) string {
+	var stats []string
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil {
+			stats = append(stats, fmt.Sprintf("%s:%d:%d", file, fi.Size(), fi.ModTime().UnixNano()))
+		} else {
+			stats = append(stats, file+":")
+		}
+	}
+	sort.Strings(stats)
+	return strings.Join(stats, "\x00")
+}
+
+// serverFingerprint identifies the config of a server handler chain - including any
+// access log inherited from the global config.
+func serverFingerprint(cfg config.HTTPServerConfig, accessLogSpec string) string {
+	var raw []byte
+	if cfg.Handler != nil {
+		raw = compactJSON(cfg.Handler.RawMessage)
+	}
+	limit := strconv.FormatInt(cfg.MaxRequestBody, 10)
+	return strings.Join([]string{string(raw), accessLogSpec, cfg.Metrics, limit, cfg.MaxRequestBodyError, middlewareFingerprint(cfg.Middleware)}, "\x00")
+}
+
+// compactJSON removes insignificant white space, so formatting changes don't count as config changes.
+func compactJSON(data []byte) []byte {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// persistentService runs a handler service across generations.
+// It's started by the first generation serving it and keeps running until its
+// component is released.
+type persistentService struct {
+	daemon.Server
+
+	mu      sync.Mutex
+	started bool
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// Serve starts the service - unless already running - and returns when ctx is canceled.
+func (s *persistentService) Serve(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.started {
+		var sctx context.Context
+		sctx, s.cancel = context.WithCancel(context.Background())
+		s.done = make(chan struct{})
+		s.started = true
+		go func() {
+			defer close(s.done)
+			if err := s.Server.Serve(sctx); err != nil {
+				log.ERROR("Handler service failed", "service", s.Description(), "err", err)
+			}
+		}()
+	}
+	done := s.done
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+	case <-done:
+	}
+	return nil
+}
+
+// stop stops the service and waits for it to exit.
+func (s *persistentService) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+func (s *persistentService) Description() string {
+	if d, ok := s.Server.(interface{ Description() string }); ok {
+		return d.Description()
+	}
+	return "Handler service"
+}
+
+// reloadResult is the outcome of configuring a new generation.
+type reloadResult struct {
+	summary reloadSummary
+	err     error
+}
+
+// reloadNotifier lets the control socket wait for the result of a reload.
+// Waiters only get the result of a configuration started after they started waiting,
+// to not report on a config loaded before it was changed.
+// A successful configuration is only reported when its servers are listening and serving
+// - or have failed to listen.
+type reloadNotifier struct {
+	mu      sync.Mutex
+	started int                       // configurations started
+	waiters map[chan reloadResult]int // configurations started when waiting began
+	pending *pendingReload            // configured, but not yet serving
+}
+
+type pendingReload struct {
+	seq    int
+	result reloadResult
+}
+
+var reloads = &reloadNotifier{waiters: make(map[chan reloadResult]int)}
+
+// start records the start of a configuration, returning its sequence number.
+func (n *reloadNotifier) start() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.started++
+	return n.started
+}
+
+// wait returns a channel receiving the result of the next configuration started.
+func (n *reloadNotifier) wait() chan reloadResult {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch := make(chan reloadResult, 1)
+	n.waiters[ch] = n.started
+	return ch
+}
+
+// cancel stops waiting.
+func (n *reloadNotifier) cancel(ch chan reloadResult) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.waiters, ch)
+}
+
+// done delivers the result of configuration seq to the waiters.
+func (n *reloadNotifier) done(seq int, result reloadResult) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.deliver(seq, result)
+}
+
+// configured records the result of configuration seq to deliver when its servers are serving.
+func (n *reloadNotifier) configured(seq int, result reloadResult) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = &pendingReload{seq: seq, result: result}
+}
+
+// serving delivers the pending result when the servers are serving.
+func (n *reloadNotifier) serving() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if p := n.pending; p != nil {
+		n.pending = nil
+		n.deliver(p.seq, p.result)
+	}
+}
+
+// failed delivers the pending result as failed, when the servers failed to listen.
+func (n *reloadNotifier) failed(err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if p := n.pending; p != nil {
+		n.pending = nil
+		n.deliver(p.seq, reloadResult{err: fmt.Errorf("Servers failed to listen: %w", err)})
+	}
+}
+
+func (n *reloadNotifier) deliver(seq int, result reloadResult) {
+	for ch, waitseq := range n.waiters {
+		if waitseq < seq {
+			ch <- result
+			delete(n.waiters, ch)
+		}
+	}
+}
@@ -66,8 +66,21 @@ func rangeCodeTest(val int) func(int) bool {
 	}
 }
 
+// tooLargeCounter registers the counter of requests rejected by MaxRequestBody if the
+// metrics spec has "toolarge" - or returns nil.
+func tooLargeCounter(name, spec string) *metric.Counter {
+	for _, spc := range strings.Split(spec, ",") {
+		if spc == "toolarge" {
+			log.DEBUG("Creating request body limit metric")
+			return metric.RegisterCounter(name + ".too-large")
+		}
+	}
+	return nil
+}
+
 // Creates an accesslog.AuditFunction based on the provided metrics spec, which
-// increments metrics counters
+// increments metrics counters.
+// "toolarge" is counted by the request body limit. See tooLargeCounter.
 func metricsFunction(name, spec string) accesslog.AuditFunction {
 
 	var meters []meter
@@ -0,0 +1,103 @@
+package ozone
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/One-com/ozone/v2/config"
+	"github.com/One-com/ozone/v2/handlers/compress"
+	"github.com/One-com/ozone/v2/handlers/router"
+	"github.com/One-com/ozone/v2/handlers/rproxy"
+	"github.com/One-com/ozone/v2/handlers/static"
+)
+
+// Schemas of the configs of handler and TLS plugin types - by type name.
+// Types without a schema can have any config.
+var handlerSchemas = map[string]func() config.Schema{
+	"ReverseProxy": rproxy.ConfigSchema,
+	"Redirect":     func() config.Schema { return config.SchemaOf(&config.RedirectHandlerConfig{}) },
+	"Router":       func() config.Schema { return config.SchemaOf(&router.Config{}) },
+	"Static":       func() config.Schema { return config.SchemaOf(&static.Config{}) },
+}
+var tlsPluginSchemas = map[string]func() config.Schema{}
+var middlewareSchemas = map[string]func() config.Schema{
+	"Headers":  func() config.Schema { return config.SchemaOf(&HeadersMiddlewareConfig{}) },
+	"Compress": func() config.Schema { return config.SchemaOf(&compress.Config{}) },
+}
+
+// RegisterHTTPHandlerSchema provides the config of a handler type for generating a JSON Schema of
+// the config. cfg is typically a pointer to the struct the handler config is parsed into - or
+// a config.Schema.
+// Not go-routine safe.
+func RegisterHTTPHandlerSchema(typename string, cfg interface{}) {
+	handlerSchemas[typename] = func() config.Schema { return config.SchemaOf(cfg) }
+}
+
+// RegisterTLSPluginSchema provides the config of a TLS plugin type for generating a JSON Schema of
+// the config. cfg is typically a pointer to the struct the plugin config is parsed into - or
+// a config.Schema.
+// Not go-routine safe.
+func RegisterTLSPluginSchema(typename string, cfg interface{}) {
+	tlsPluginSchemas[typename] = func() config.Schema { return config.SchemaOf(cfg) }
+}
+
+// RegisterMiddlewareSchema provides the config of a middleware type for generating a JSON Schema
+// of the config. cfg is typically a pointer to the struct the middleware config is parsed into - or
+// a config.Schema.
+// Not go-routine safe.
+func RegisterMiddlewareSchema(typename string, cfg interface{}) {
+	middlewareSchemas[typename] = func() config.Schema { return config.SchemaOf(cfg) }
+}
+
+// ConfigSchema returns a JSON Schema for the config, including the config of all built in and
+// registered handler types, middleware types, TLS plugin types and reverse proxy modules with a schema.
+// Editors and CI can use it to validate configs.
+func ConfigSchema() config.Schema {
+	s := config.SchemaOf(&config.Config{})
+	s["$schema"] = config.SchemaDraft
+	s["title"] = "Ozone config"
+
+	// A server handler is either a handler name or a map of URL paths to handler names (a mux).
+	if server := s.Property("HTTP").Elements(); server != nil {
+		server["properties"].(config.Schema)["Handler"] = config.Schema{
+			"oneOf": []interface{}{
+				config.Schema{"type": "string"},
+				config.Schema{"type": "object", "additionalProperties": config.Schema{"type": "string"}},
+			},
+		}
+	}
+
+	handlers := make(map[string]config.Schema)
+	for name, f := range handlerSchemas {
+		handlers[name] = f()
+	}
+	s.Property("Handlers").Elements().SetTypedConfig("Config", handlers)
+
+	middleware := make(map[string]config.Schema)
+	for name, f := range middlewareSchemas {
+		middleware[name] = f()
+	}
+	for _, parent := range []config.Schema{s.Property("HTTP").Elements(), s.Property("Handlers").Elements()} {
+		if items, ok := parent.Property("Middleware")["items"].(config.Schema); ok {
+			items.SetTypedConfig("Config", middleware)
+		}
+	}
+
+	plugins := make(map[string]config.Schema)
+	for name, f := range tlsPluginSchemas {
+		plugins[name] = f()
+	}
+	s.Property("TLSPlugins").Elements().SetTypedConfig("Config", plugins)
+
+	return s
+}
+
+// writeSchema writes the config JSON Schema.
+func writeSchema(w io.Writer) error {
+	b, err := json.MarshalIndent(ConfigSchema(), "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/One-com/gone/daemon"
 	"github.com/One-com/gone/http/handlers/accesslog"
 	"github.com/One-com/gone/log"
+	"github.com/One-com/gone/metric"
 
 	"github.com/One-com/gone/jconf"
 
@@ -54,31 +55,42 @@ func RegisterTLSPluginType(typename string, f TLSPluginConfigureFunc) {
 // Access logging can be configured globally or individual for all servers.
 // Metrics is set per server or per handler
 //
-func instantiateServersFromConfig(cfgdata interface{}) (servers []daemon.Server, cleanups []daemon.CleanupFunc, cfg *config.Config, err error) {
-
-	switch c := cfgdata.(type) {
-	case string:
-		cfg, err = config.ParseConfigFromFile(c)
-	case io.ReadSeeker:
-		cfg, err = config.ParseConfigFromReadSeeker(c)
-	default:
-		err = fmt.Errorf("Dont know how to read config from (%T)", c)
-		return
-	}
+// Configuration doesn't stop at the first error. All errors found are returned
+// as a config.Errors list locating each error by its path in the config.
+// If validate is true, everything is instantiated, but nothing is registered
+// with the running process (access logs, metrics) and the caller is expected to
+// run the cleanups and discard the generation right away.
+//
+// Handlers and server handler chains are recorded in gen. Those unchanged since
+// the previous generation are kept instead of being built again.
+// Their cleanup is left to the generation.
+func instantiateServersFromConfig(cfgdata interface{}, validate bool, gen *generation) (servers []daemon.Server, cleanups []daemon.CleanupFunc, cfg *config.Config, err error) {
 
+	cfg, err = parseConfigSpec(cfgdata)
 	if err != nil || cfg == nil {
 		err = config.WrapError(err)
 		return
 	}
 
+	var errs config.Errors
+	defer func() {
+		sortErrors(errs)
+		err = errs.Err()
+		if err != nil {
+			// Nobody will run the servers. Clean up what was made.
+			runCleanups(cleanups)
+			gen.discard()
+			servers, cleanups = nil, nil
+		}
+	}()
+
 	// Initialize internal services like metrics and SNI (if configured)
 	metricsService, e := loadMetricsConfig(cfg.Metrics)
 	if e != nil {
-		err = e
-		log.CRIT("Error processing 'Metrics' configuration section", "err", err)
-		return
+		log.CRIT("Error processing 'Metrics' configuration section", "err", e)
+		collectError(&errs, e, "Metrics")
 	}
-	if metricsService != nil {
+	if metricsService != nil && !validate {
 		servers = append(servers, metricsService)
 	}
 
@@ -88,15 +100,18 @@ func instantiateServersFromConfig(cfgdata interface{}) (servers []daemon.Server,
 	//-----------------------------------------------------------
 	// Initialize configured HTTP services with handlers
 
-	handlerRegistry := newHandlerRegistry(cfg.Handlers)
+	handlerRegistry := newHandlerRegistry(cfg.Handlers, validate, gen)
 
 	accessLogSpec := ""
 	if cfg.Log != nil {
 		accessLogSpec = cfg.Log.AccessLog
+		if validate && accessLogSpec != "" {
+			collectError(&errs, checkAccessLogSpec(accessLogSpec), "Log", "AccessLog")
+		}
 	}
 
-HTTP_SETUP:
-	for srvName, srvCfg := range cfg.HTTPServers {
+	for _, srvName := range cfg.HTTPServers.Names() {
+		srvCfg := cfg.HTTPServers[srvName]
 
 		var handler http.Handler
 		var handlerSpec interface{}
@@ -104,60 +119,131 @@ HTTP_SETUP:
 		// Allow for server handler specification to be more than a string.
 		// ...mostly used for a mux.
 		handlerJSON := srvCfg.Handler
-		err = handlerJSON.ParseInto(&handlerSpec)
-		if err != nil {
-			break HTTP_SETUP
+		e = handlerJSON.ParseInto(&handlerSpec)
+		if e != nil {
+			collectError(&errs, e, "HTTP", srvName, "Handler")
+			continue
 		}
 
 		// shadow accessLogspec to set the default - if any.
 		accessLogSpec := accessLogSpec
 		if srvCfg.AccessLog != "" {
 			accessLogSpec = srvCfg.AccessLog
+			if validate {
+				collectError(&errs, checkAccessLogSpec(accessLogSpec), "HTTP", srvName, "AccessLog")
+			}
 		}
 
-		// Look up the HTTP handler for this server by handlerSpec
-		handler, err = handlerRegistry.HandlerForSpec(srvName, handlerSpec)
-		if err != nil {
-			break HTTP_SETUP // bail out, return error
+		// Keep the handler chain of the previous generation if nothing changed.
+		fingerprint := serverFingerprint(srvCfg, accessLogSpec)
+		chain := gen.previousServer(srvName, fingerprint)
+		if chain != nil && !handlerRegistry.unchanged(chain.deps) {
+			chain = nil
 		}
 
-		// If handler lookup is OK, Wrap it in any access logging and/or metrics,
-		// Create the server with the resulting handler and append it to the
-		// list of servers to serve.
+		if chain == nil {
+			chain = &component{fingerprint: fingerprint}
 
-		// any metrics for this server.
-		var mfunc accesslog.AuditFunction
-		if srvCfg.Metrics != "" {
-			mfunc = metricsFunction(srvName, srvCfg.Metrics)
-		}
+			// Look up the HTTP handler for this server by handlerSpec
+			handler, chain.deps, e = handlerRegistry.resolveSpec(srvName, handlerSpec)
+			if e != nil {
+				collectError(&errs, e, "HTTP", srvName, "Handler")
+				continue
+			}
+
+			handler, e = wrapMiddleware(handler, srvCfg.Middleware)
+			if e != nil {
+				collectError(&errs, e, "HTTP", srvName, "Middleware")
+				continue
+			}
 
-		// Always wrap handler with audithandler to allow dynamic accesslog.
-		wrappedHandler, logcleanup := wrapAuditHandler(srvName, handler, accessLogSpec, mfunc)
-		if logcleanup != nil {
-			cleanups = append(cleanups, logcleanup)
+			// If handler lookup is OK, Wrap it in any access logging and/or metrics,
+			// Create the server with the resulting handler and append it to the
+			// list of servers to serve.
+			// When validating, there's no process to register access logs and metrics with.
+			var tooLarge *metric.Counter
+			if !validate {
+				tooLarge = tooLargeCounter(srvName, srvCfg.Metrics)
+			}
+			handler = limitRequestBody(handler, srvCfg.MaxRequestBody, srvCfg.MaxRequestBodyError, tooLarge)
+
+			if !validate {
+				// any metrics for this server.
+				var mfunc accesslog.AuditFunction
+				if srvCfg.Metrics != "" {
+					mfunc = metricsFunction(srvName, srvCfg.Metrics)
+				}
+
+				// Always wrap handler with audithandler to allow dynamic accesslog.
+				wrappedHandler, logcleanup := wrapAuditHandler(srvName, handler, accessLogSpec, mfunc)
+				if logcleanup != nil {
+					chain.cleanups = append(chain.cleanups, logcleanup)
+				}
+				handler = wrappedHandler
+			}
+			chain.handler = handler
 		}
+		gen.servers[srvName] = chain
+		handler = chain.handler
+
 		// Create the actual server with the resulting handler
-		server, e := newHTTPServer(srvName, srvCfg, tlsPluginRegistry, wrappedHandler)
+		server, e := newHTTPServer(srvName, srvCfg, tlsPluginRegistry, handler)
 		if e != nil {
-			err = e
-			log.CRIT(fmt.Sprintf("Failed to initialize service '%s'", srvName), "err", err)
-			break HTTP_SETUP
+			log.CRIT(fmt.Sprintf("Failed to initialize service '%s'", srvName), "err", e)
+			collectError(&errs, e, "HTTP", srvName)
+			continue
 		}
 
 		servers = append(servers, server)
 	}
 
-	// Add services and cleanups generated by handlers
+	// Validation also covers handlers no server references.
+	if validate {
+		for _, name := range cfg.Handlers.Names() {
+			handlerRegistry.handlerByName(name)
+		}
+	}
+
+	// Add services generated by handlers. Their cleanups are left to the generation.
 	servers = append(servers, handlerRegistry.Services()...)
-	cleanups = append(cleanups, handlerRegistry.Cleanups()...)
+	errs.Add(handlerRegistry.Errors())
 
 	// Add services from the TLSPluginRegistry
 	servers = append(servers, tlsPluginRegistry.Services...)
 	cleanups = append(cleanups, tlsPluginRegistry.Cleanups...)
+	errs.Add(tlsPluginRegistry.Errors.Err())
 
 	return
 }
 
+// parseConfigSpec parses the config given either as a file name or an in memory buffer.
+// The format is given by the file extensions - or the ConfigFormat Option.
+func parseConfigSpec(cfgdata interface{}) (*config.Config, error) {
+	switch c := cfgdata.(type) {
+	case string:
+		return config.ParseConfigFromFileAs(c, cfg.format)
+	case io.ReadSeeker:
+		return config.ParseConfigFromReadSeekerAs(c, cfg.format)
+	case ConfigProvider:
+		return provideConfig(c)
+	case func() (*config.Config, error):
+		return provideConfig(c)
+	}
+	return nil, fmt.Errorf("Dont know how to read config from (%T)", cfgdata)
+}
+
+// provideConfig gets the config from a ConfigProvider.
+func provideConfig(provider ConfigProvider) (*config.Config, error) {
+	c, err := provider()
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, errors.New("Config provider returned no config")
+	}
+	return c, nil
+}
+
 func getTLSServerConfigWithPlugin(cfg *config.TLSServerConfig, plugins *tlsPluginRegistry) (tlsConf *tls.Config, err error) {
 
 	var tc *tls.Config
@@ -180,7 +266,8 @@ func getTLSServerConfigWithPlugin(cfg *config.TLSServerConfig, plugins *tlsPlugi
 			return
 		}
 		if modifyConfigF == nil {
-			log.Fatal(fmt.Sprintf("TLS plugin enabled but plugin '%s' not found", pluginname))
+			err = config.AtPath(fmt.Errorf("TLS plugin enabled but plugin '%s' not found", pluginname), "TLSPlugin")
+			return
 		}
 		err = modifyConfigF(tc)
 		if err != nil {
@@ -201,40 +288,74 @@ type tlsPluginRegistry struct {
 
 	// map of instantiated tls plugins - by name
 	callbacks map[string]func(*tls.Config) error
+	// plugins which failed and already are reported in Errors
+	failed map[string]bool
 
 	// resulting services and cleanups
 	Services []daemon.Server
 	Cleanups []daemon.CleanupFunc
+	Errors   config.Errors
 }
 
 // newTLSPluginRegistry initializes a tlsPluginRegistry for plugin resolution with a default plugin entry named ""
 func newTLSPluginRegistry(plugindir string, tlsplugcfg config.TLSPluginsConfig, defaultcfg *jconf.OptionalSubConfig) (registry *tlsPluginRegistry) {
 
-	// Add fallback legacy default plugin
-	if tlsplugcfg == nil {
-		tlsplugcfg = make(config.TLSPluginsConfig) // make a map (notice the plural)
+	// Add fallback legacy default plugin to a copy, leaving the callers config untouched
+	plugins := make(config.TLSPluginsConfig, len(tlsplugcfg)+1) // make a map (notice the plural)
+	for name, plugcfg := range tlsplugcfg {
+		plugins[name] = plugcfg
 	}
-	tlsplugcfg[""] = config.TLSPluginConfig{Type: "", Plugin: "default_sni.so", Config: defaultcfg}
+	plugins[""] = config.TLSPluginConfig{Type: "", Plugin: "default_sni.so", Config: defaultcfg}
 
 	if plugindir == "" {
 		plugindir = TLSPLUGINPATH
 	}
 
-	registry = &tlsPluginRegistry{dir: plugindir, cfg: tlsplugcfg}
+	registry = &tlsPluginRegistry{
+		dir:       plugindir,
+		cfg:       plugins,
+		callbacks: make(map[string]func(*tls.Config) error),
+		failed:    make(map[string]bool),
+	}
 
 	return
 }
 
 // getTLSPlugin returns a tls.Config manipulating callback based on it's name, or...
 // in the case it's not configured, create it from plugins.
+// Errors configuring the plugin are reported once in r.Errors at the path of the plugin config.
 func (r *tlsPluginRegistry) getTLSPlugin(name string) (cb func(*tls.Config) error, err error) {
 
 	var exists bool
 	if cb, exists = r.callbacks[name]; exists {
 		return
 	}
+	if r.failed[name] {
+		err = &dependencyError{kind: "TLS plugin", name: name}
+		return
+	}
+
+	cb, err = r.configureTLSPlugin(name)
+	if err != nil {
+		// The legacy default plugin is configured by "SNI"
+		path := []string{"TLSPlugins", name}
+		if name == "" {
+			path = []string{"SNI"}
+		}
+		collectError(&r.Errors, err, path...)
+		r.failed[name] = true
+		err = &dependencyError{kind: "TLS plugin", name: name}
+		return
+	}
+	if cb != nil {
+		r.callbacks[name] = cb
+	}
+	return
+}
+
+func (r *tlsPluginRegistry) configureTLSPlugin(name string) (cb func(*tls.Config) error, err error) {
 
-	// We haven't instantiated this tlsplugin yet, so:
+	var exists bool
 
 	// find the config
 	var cfg config.TLSPluginConfig
@@ -253,7 +374,7 @@ func (r *tlsPluginRegistry) getTLSPlugin(name string) (cb func(*tls.Config) erro
 		filename := cfg.Plugin
 		if filename[0] != '/' {
 			if r.dir == "" {
-				err = errors.New("Can't create absolute path for TLS Plugin. Set TLSPluginDir in config")
+				err = config.AtPath(errors.New("Can't create absolute path for TLS Plugin. Set TLSPluginDir in config"), "Plugin")
 				return
 			}
 			filename = r.dir + "/" + filename
@@ -261,13 +382,13 @@ func (r *tlsPluginRegistry) getTLSPlugin(name string) (cb func(*tls.Config) erro
 
 		abspath, e := filepath.Abs(filename)
 		if e != nil {
-			err = e
+			err = config.AtPath(e, "Plugin")
 			return
 		}
 
 		p, e := plugin.Open(abspath)
 		if e != nil {
-			err = e
+			err = config.AtPath(e, "Plugin")
 			return
 		}
 
@@ -280,7 +401,7 @@ func (r *tlsPluginRegistry) getTLSPlugin(name string) (cb func(*tls.Config) erro
 		} else {
 			m := s.(*map[string]TLSPluginConfigureFunc)
 			if m == nil {
-				err = errors.New("Defect TLS plugin type map")
+				err = config.AtPath(errors.New("Defect TLS plugin type map"), "Plugin")
 				return
 			}
 			f = (*m)[cfg.Type]
@@ -290,7 +411,7 @@ func (r *tlsPluginRegistry) getTLSPlugin(name string) (cb func(*tls.Config) erro
 	}
 
 	if initf == nil {
-		err = errors.New("No TLS plugin initializer")
+		err = config.AtPath(errors.New("No TLS plugin initializer"), "Type")
 		return
 	}
 
@@ -298,6 +419,7 @@ func (r *tlsPluginRegistry) getTLSPlugin(name string) (cb func(*tls.Config) erro
 	var cleanups []daemon.CleanupFunc
 	cb, servers, cleanups, err = initf(name, cfg.Config)
 	if err != nil {
+		err = config.AtPath(err, "Config")
 		return
 	}
 
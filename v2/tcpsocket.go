@@ -0,0 +1,162 @@
+package ozone
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/One-com/gone/daemon"
+	"github.com/One-com/gone/log"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// tcpSocket holds the socket options of a TCP listener.
+type tcpSocket struct {
+	acceptors   int // listening sockets with SO_REUSEPORT - 0 for a single plain socket
+	backlog     int
+	readBuffer  int
+	writeBuffer int
+	keepAlive   time.Duration // 0 to leave as Go does, negative to disable
+	noDelay     *bool
+	deferAccept time.Duration
+	fastOpen    int
+}
+
+// newTCPSocket checks the socket options of a TCP listener. Errors are located relative to the listener config.
+func newTCPSocket(lcfg config.ListenerConfig) (sock *tcpSocket, err error) {
+	var errs config.Errors
+
+	sock = &tcpSocket{
+		backlog:     lcfg.Backlog,
+		readBuffer:  lcfg.ReadBuffer,
+		writeBuffer: lcfg.WriteBuffer,
+		keepAlive:   lcfg.KeepAlive.Duration,
+		noDelay:     lcfg.NoDelay,
+		deferAccept: lcfg.DeferAccept.Duration,
+		fastOpen:    lcfg.FastOpen,
+	}
+
+	if lcfg.ReusePort {
+		sock.acceptors = 1
+	}
+	switch {
+	case lcfg.Acceptors < 0:
+		errs.Add(config.AtPath(errors.New("Acceptors must not be negative"), "Acceptors"))
+	case lcfg.Acceptors > 1 && !lcfg.ReusePort:
+		errs.Add(config.AtPath(errors.New("More Acceptors requires ReusePort"), "Acceptors"))
+	case lcfg.Acceptors > 1:
+		sock.acceptors = lcfg.Acceptors
+	}
+
+	if lcfg.ReusePort && !socketOptionsSupported {
+		errs.Add(config.AtPath(errors.New("ReusePort not supported on this platform"), "ReusePort"))
+	}
+
+	options := []struct {
+		name  string
+		value int64
+	}{
+		{"Backlog", int64(lcfg.Backlog)},
+		{"ReadBuffer", int64(lcfg.ReadBuffer)},
+		{"WriteBuffer", int64(lcfg.WriteBuffer)},
+		{"DeferAccept", int64(lcfg.DeferAccept.Duration)},
+		{"FastOpen", int64(lcfg.FastOpen)},
+	}
+	for _, o := range options {
+		switch {
+		case o.value < 0:
+			errs.Add(config.AtPath(fmt.Errorf("%s must not be negative", o.name), o.name))
+		case o.value != 0 && !socketOptionsSupported:
+			errs.Add(config.AtPath(fmt.Errorf("%s not supported on this platform", o.name), o.name))
+		}
+	}
+	return sock, errs.Err()
+}
+
+// listenerOptions tells whether any options are set on the listening socket.
+func (s *tcpSocket) listenerOptions() bool {
+	return s.backlog != 0 || s.readBuffer != 0 || s.writeBuffer != 0 || s.deferAccept != 0 || s.fastOpen != 0
+}
+
+// prepare sets the options of the listening socket. It's done on every generation of servers,
+// since the socket may be inherited. Options not set are left as they were.
+// The returned listener sets the options of accepted connections.
+func (s *tcpSocket) prepare(l net.Listener) net.Listener {
+	if s.listenerOptions() {
+		if err := s.setListenerOptions(l); err != nil {
+			log.ERROR("Failed to set listener socket options", "addr", l.Addr(), "err", err)
+		}
+	}
+	if s.keepAlive == 0 && s.noDelay == nil {
+		return l
+	}
+	return &tcpOptionsListener{Listener: l, keepAlive: s.keepAlive, noDelay: s.noDelay}
+}
+
+// tcpOptionsListener sets keepalive and TCP_NODELAY on accepted connections.
+type tcpOptionsListener struct {
+	net.Listener
+	keepAlive time.Duration
+	noDelay   *bool
+}
+
+func (l *tcpOptionsListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := c.(*net.TCPConn); ok {
+		if l.keepAlive < 0 {
+			tc.SetKeepAlive(false)
+		} else if l.keepAlive > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(l.keepAlive)
+		}
+		if l.noDelay != nil {
+			tc.SetNoDelay(*l.noDelay)
+		}
+	}
+	return c, nil
+}
+
+// listenerSpec is a listener of a server - possibly with more acceptor sockets.
+type listenerSpec struct {
+	daemon.ListenerSpec
+	acceptors int         // listen with SO_REUSEPORT on this many sockets if not 0
+	socket    *unixSocket // for UNIX socket listeners
+}
+
+// listenerGroup listens on the listeners of a server.
+type listenerGroup struct {
+	specs []listenerSpec
+}
+
+func (g *listenerGroup) Listen() (listeners []net.Listener, err error) {
+	// Close any already listening listeners on error exit
+	defer func() {
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}()
+
+	for _, spec := range g.specs {
+		var ls []net.Listener
+		switch {
+		case spec.socket != nil:
+			ls, err = spec.socket.listen(spec.ListenerSpec)
+		case spec.acceptors == 0:
+			ls, err = daemon.ListenerGroup{spec.ListenerSpec}.Listen()
+		default:
+			ls, err = listenReusePort(spec.ListenerSpec, spec.acceptors)
+		}
+		if err != nil {
+			return
+		}
+		listeners = append(listeners, ls...)
+	}
+	return
+}
@@ -0,0 +1,154 @@
+//go:build linux
+
+package ozone
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/One-com/gone/daemon"
+	"github.com/One-com/gone/sd"
+)
+
+// Not in the frozen syscall package.
+const (
+	soReusePort = 0x0F
+	tcpFastOpen = 0x17
+)
+
+const socketOptionsSupported = true
+
+// setListenerOptions sets the options of a listening socket. Listening again
+// on a listening socket changes the backlog.
+func (s *tcpSocket) setListenerOptions(l net.Listener) (err error) {
+	sc, ok := l.(syscall.Conn)
+	if !ok {
+		return errors.New("Not a socket")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return
+	}
+	cerr := rc.Control(func(fd uintptr) {
+		if s.readBuffer != 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, s.readBuffer); err != nil {
+				return
+			}
+		}
+		if s.writeBuffer != 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, s.writeBuffer); err != nil {
+				return
+			}
+		}
+		if s.deferAccept != 0 {
+			secs := int((s.deferAccept + time.Second - 1) / time.Second)
+			if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_DEFER_ACCEPT, secs); err != nil {
+				return
+			}
+		}
+		if s.fastOpen != 0 {
+			if err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpen, s.fastOpen); err != nil {
+				return
+			}
+		}
+		if s.backlog != 0 {
+			err = syscall.Listen(int(fd), s.backlog)
+		}
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return
+}
+
+func setReusePort(network, address string, c syscall.RawConn) (err error) {
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		err = cerr
+	}
+	return
+}
+
+// listenReusePort listens on n sockets with SO_REUSEPORT on the address of the spec - like
+// daemon.ListenerGroup, first trying to inherit each socket from the sd library.
+// Inherited sockets may be listening without SO_REUSEPORT, when ReusePort is turned on by
+// a reload, so it's set on them before the new sockets are bound next to them.
+// If the port is 0, all the sockets listen on the port chosen for the first.
+func listenReusePort(spec daemon.ListenerSpec, n int) (listeners []net.Listener, err error) {
+	// Close any already listening listeners on error exit
+	defer func() {
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+		}
+	}()
+
+	lc := net.ListenConfig{Control: setReusePort}
+	addr := spec.Addr
+	for i := 0; i < n; i++ {
+		var taddr *net.TCPAddr
+		taddr, err = net.ResolveTCPAddr(spec.Net, addr)
+		if err != nil {
+			return
+		}
+
+		filetests := []sd.FileTest{sd.IsTCPListener(taddr)}
+		filetests = append(filetests, spec.ExtraFileTests...)
+
+		var ln net.Listener
+		ln, _, err = sd.InheritNamedListener(spec.ListenerFdName, filetests...)
+		if err != nil {
+			return
+		}
+		if ln != nil {
+			var rc syscall.RawConn
+			if sc, ok := ln.(syscall.Conn); !ok {
+				err = errors.New("Not a socket")
+			} else if rc, err = sc.SyscallConn(); err == nil {
+				err = setReusePort(spec.Net, addr, rc)
+			}
+			if err != nil {
+				ln.Close()
+				return
+			}
+		} else {
+			if spec.InheritOnly {
+				err = daemon.ErrNoListener
+				return
+			}
+			ln, err = lc.Listen(context.Background(), spec.Net, addr)
+			if err != nil {
+				return
+			}
+			err = sd.Export(spec.ListenerFdName, ln)
+			if err != nil {
+				ln.Close()
+				return
+			}
+		}
+
+		if taddr.Port == 0 {
+			if bound, ok := ln.Addr().(*net.TCPAddr); ok {
+				host, _, _ := net.SplitHostPort(addr)
+				addr = net.JoinHostPort(host, strconv.Itoa(bound.Port))
+			}
+		}
+
+		if spec.PrepareListener != nil {
+			ln = spec.PrepareListener(ln)
+		}
+		if spec.TLSConfig != nil {
+			ln = tls.NewListener(ln, spec.TLSConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	return
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+
+package ozone
+
+import (
+	"errors"
+	"net"
+
+	"github.com/One-com/gone/daemon"
+)
+
+// Socket options on the listening socket are only implemented on Linux.
+const socketOptionsSupported = false
+
+func (s *tcpSocket) setListenerOptions(l net.Listener) error {
+	return errors.New("Socket options not supported on this platform")
+}
+
+func listenReusePort(spec daemon.ListenerSpec, n int) ([]net.Listener, error) {
+	return nil, errors.New("ReusePort not supported on this platform")
+}
@@ -0,0 +1,292 @@
+package ozone
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/One-com/gone/daemon"
+	"github.com/One-com/gone/log"
+	"github.com/One-com/gone/sd"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// unixSocket is the file of a UNIX socket listener to set permissions on.
+type unixSocket struct {
+	path     string
+	mode     os.FileMode // 0 for the mode given by the umask
+	uid, gid int         // -1 to leave as created
+}
+
+// newUnixSocket checks the config of a UNIX socket listener. Errors are located relative to the listener config.
+func newUnixSocket(lcfg config.ListenerConfig) (sock *unixSocket, err error) {
+	var errs config.Errors
+
+	if lcfg.Path == "" {
+		errs.Add(config.AtPath(errors.New("UNIX socket listener needs a Path"), "Path"))
+	}
+	if lcfg.Address != "" || lcfg.Port != 0 {
+		errs.Add(config.AtPath(errors.New("UNIX socket listener has no Address or Port"), "Address"))
+	}
+
+	sock = &unixSocket{path: lcfg.Path, uid: -1, gid: -1}
+	abstract := strings.HasPrefix(lcfg.Path, "@")
+
+	if lcfg.Mode != "" {
+		mode, e := strconv.ParseUint(lcfg.Mode, 8, 32)
+		switch {
+		case abstract:
+			e = errors.New("Abstract sockets have no file mode")
+		case e != nil || mode > 0777:
+			e = fmt.Errorf("Bad file mode: %s", lcfg.Mode)
+		}
+		errs.Add(config.AtPath(e, "Mode"))
+		sock.mode = os.FileMode(mode)
+	}
+	if lcfg.Owner != "" {
+		var e error
+		if abstract {
+			e = errors.New("Abstract sockets have no owner")
+		} else {
+			sock.uid, sock.gid, e = lookupOwner(lcfg.Owner)
+		}
+		errs.Add(config.AtPath(e, "Owner"))
+	}
+	return sock, errs.Err()
+}
+
+// lookupOwner resolves "user" or "user:group" - by name or id.
+func lookupOwner(owner string) (uid, gid int, err error) {
+	uid, gid = -1, -1
+	username, groupname, hasGroup := strings.Cut(owner, ":")
+
+	if username != "" {
+		var u *user.User
+		if u, err = user.Lookup(username); err != nil {
+			if u, err = user.LookupId(username); err != nil {
+				return -1, -1, fmt.Errorf("Unknown user: %s", username)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+	}
+	if hasGroup && groupname != "" {
+		var g *user.Group
+		if g, err = user.LookupGroup(groupname); err != nil {
+			if g, err = user.LookupGroupId(groupname); err != nil {
+				return -1, -1, fmt.Errorf("Unknown group: %s", groupname)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+	return uid, gid, nil
+}
+
+// listen listens on the socket. A socket file with a configured mode is bound giving only the
+// owner access, so the file is never more accessible than configured before prepare sets its
+// owner and mode.
+// Sockets are inherited from the sd library like daemon.ListenerGroup does, but
+// only if the socket file still exists, else a new socket file is bound.
+func (s *unixSocket) listen(spec daemon.ListenerSpec) ([]net.Listener, error) {
+	if strings.HasPrefix(s.path, "@") {
+		return daemon.ListenerGroup{spec}.Listen()
+	}
+	s.removeIfStale()
+
+	uaddr, err := net.ResolveUnixAddr(spec.Net, spec.Addr)
+	if err != nil {
+		return nil, err
+	}
+	filetests := []sd.FileTest{sd.IsUNIXListener(uaddr), s.fileExists}
+	filetests = append(filetests, spec.ExtraFileTests...)
+
+	ln, _, err := sd.InheritNamedListener(spec.ListenerFdName, filetests...)
+	if err != nil {
+		return nil, err
+	}
+	if ln == nil {
+		if spec.InheritOnly {
+			return nil, daemon.ErrNoListener
+		}
+		var lc net.ListenConfig
+		if s.mode != 0 {
+			lc.Control = ownerOnly
+		}
+		if ln, err = lc.Listen(context.Background(), spec.Net, spec.Addr); err != nil {
+			return nil, err
+		}
+		if err = sd.Export(spec.ListenerFdName, ln); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	if spec.PrepareListener != nil {
+		ln = spec.PrepareListener(ln)
+	}
+	if spec.TLSConfig != nil {
+		ln = tls.NewListener(ln, spec.TLSConfig)
+	}
+	return []net.Listener{ln}, nil
+}
+
+// ownerOnly gives only the owner access to a socket before it's bound. Linux creates the
+// socket file with the mode of the socket (minus the umask). Other systems may not support
+// it, leaving the file with the mode given by the umask until prepare sets the mode.
+func ownerOnly(network, address string, c syscall.RawConn) error {
+	return c.Control(func(fd uintptr) {
+		syscall.Fchmod(int(fd), 0600)
+	})
+}
+
+// fileExists is a FileTest for the socket file existing.
+func (s *unixSocket) fileExists(*os.File) (bool, error) {
+	fi, err := os.Lstat(s.path)
+	return err == nil && fi.Mode()&os.ModeSocket != 0, nil
+}
+
+// prepare sets the owner and mode of the socket file and keeps the file when the listener
+// is closed, since a reloaded generation of servers inherits the listening socket.
+// The returned listener tells unixSocketFiles when it's closed.
+func (s *unixSocket) prepare(l net.Listener) net.Listener {
+	if ul, ok := l.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	if strings.HasPrefix(s.path, "@") {
+		return l
+	}
+	if s.uid != -1 || s.gid != -1 {
+		if err := os.Chown(s.path, s.uid, s.gid); err != nil {
+			log.ERROR("Failed to set socket file owner", "path", s.path, "err", err)
+		}
+	}
+	if s.mode != 0 {
+		if err := os.Chmod(s.path, s.mode); err != nil {
+			log.ERROR("Failed to set socket file mode", "path", s.path, "err", err)
+		}
+	}
+	unixSocketFiles.opened(s.path)
+	return &socketFileListener{Listener: l, path: s.path}
+}
+
+// removeIfStale removes a socket file nobody listens on - left by a process which didn't exit cleanly.
+// Sockets still listening (by this process before a reload or by the parent process on an upgrade)
+// are inherited.
+func (s *unixSocket) removeIfStale() {
+	fi, err := os.Lstat(s.path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", s.path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		log.NOTICE("Removing stale socket file", "path", s.path)
+		os.Remove(s.path)
+	}
+}
+
+// socketFileListener is a listener on a socket file, which it tells unixSocketFiles is closed.
+type socketFileListener struct {
+	net.Listener
+	path string
+	once sync.Once
+}
+
+func (l *socketFileListener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() { unixSocketFiles.closed(l.path) })
+	return err
+}
+
+// socketFiles removes the files of UNIX sockets, when they are no longer configured
+// and the last generation of servers listening on them has closed its listener.
+type socketFiles struct {
+	mu         sync.Mutex
+	open       map[string]int  // path -> listeners not closed
+	configured map[string]bool // paths of the running config
+	handedOver bool            // the sockets are served by a replacing process
+}
+
+var unixSocketFiles = &socketFiles{open: make(map[string]int), configured: make(map[string]bool)}
+
+// opened records a listener on the socket file.
+func (f *socketFiles) opened(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.open[path]++
+}
+
+// closed records a listener on the socket file being closed - removing the file
+// if it was the last one and the file is no longer configured.
+func (f *socketFiles) closed(path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.open[path]--; f.open[path] > 0 {
+		return
+	}
+	delete(f.open, path)
+	if !f.configured[path] {
+		f.remove(path)
+	}
+}
+
+// retain records the socket files configured for the servers, removing files
+// no longer configured and not listened on.
+func (f *socketFiles) retain(servers config.HTTPServersConfig) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	configured := make(map[string]bool)
+	for _, srvCfg := range servers {
+		for _, lcfg := range srvCfg.Listeners {
+			if lcfg.Network == "unix" && lcfg.Path != "" && !strings.HasPrefix(lcfg.Path, "@") {
+				configured[lcfg.Path] = true
+			}
+		}
+	}
+	for path := range f.configured {
+		if !configured[path] && f.open[path] == 0 {
+			f.remove(path)
+		}
+	}
+	f.configured = configured
+}
+
+// handOver keeps the socket files when exiting, since a replacing process serves them.
+func (f *socketFiles) handOver() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handedOver = true
+}
+
+// reset removes the socket files when the daemon has stopped.
+func (f *socketFiles) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for path := range f.configured {
+		f.remove(path)
+	}
+	f.open = make(map[string]int)
+	f.configured = make(map[string]bool)
+	f.handedOver = false
+}
+
+// remove removes the socket file - unless handed over. Called with mu held.
+func (f *socketFiles) remove(path string) {
+	if f.handedOver {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.ERROR("Failed to remove socket file", "path", path, "err", err)
+	}
+}
@@ -0,0 +1,105 @@
+package ozone
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/One-com/gone/daemon"
+	"github.com/One-com/gone/log"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// dependencyError is returned when something references a handler or TLS plugin
+// which failed to configure. The failure itself is already reported at the path
+// of the failing config, so dependency errors are not collected again.
+type dependencyError struct {
+	kind string
+	name string
+}
+
+func (e *dependencyError) Error() string {
+	return fmt.Sprintf("%s '%s' failed to configure", e.kind, e.name)
+}
+
+// collectError adds err to errs located at path - unless it's only a dependency failure.
+func collectError(errs *config.Errors, err error, path ...string) {
+	if err == nil {
+		return
+	}
+	var dep *dependencyError
+	if errors.As(err, &dep) {
+		return
+	}
+	errs.Add(config.AtPath(err, path...))
+}
+
+// sortErrors orders config errors by path to make reports stable.
+func sortErrors(errs config.Errors) {
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+}
+
+func runCleanups(cleanups []daemon.CleanupFunc) {
+	for _, f := range cleanups {
+		if f == nil {
+			continue
+		}
+		if err := f(); err != nil {
+			log.WARN("Cleanup failed", "err", err)
+		}
+	}
+}
+
+// checkAccessLogSpec tests an access log specification without opening the file.
+func checkAccessLogSpec(dest string) error {
+	if dest[0] == '|' {
+		return fmt.Errorf("Unimplemented access log spec: |")
+	}
+	dir := filepath.Dir(dest)
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("Not a directory: %s", dir)
+	}
+	return nil
+}
+
+// Validate parses the config file and configures everything in it - servers, handlers,
+// TLS plugins, reverse proxy modules and upstreams - without binding any listeners,
+// then throws the result away.
+// All errors found are returned as a config.Errors list with each error located by its
+// path in the config, like "Handlers.api.Config.Modules.hdr.Config.RequestHeader".
+func Validate(filename string) error {
+	return validateConfig(filename)
+}
+
+func validateConfig(cfgSpec interface{}) error {
+	gen := newGeneration(nil)
+	_, cleanups, _, err := instantiateServersFromConfig(cfgSpec, true, gen)
+	if err != nil {
+		return err
+	}
+	runCleanups(cleanups)
+	gen.discard()
+	return nil
+}
+
+// writeConfigErrors writes the errors in a config error list one per line.
+func writeConfigErrors(w io.Writer, err error) {
+	var list config.Errors
+	if errors.As(err, &list) {
+		for _, e := range list {
+			fmt.Fprintln(w, e.Error())
+		}
+		return
+	}
+	fmt.Fprintln(w, err.Error())
+}
@@ -0,0 +1,204 @@
+//go:build linux
+
+package ozone
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/One-com/gone/log"
+
+	"github.com/One-com/ozone/v2/config"
+)
+
+// watchDebounce is how long config files must be left alone after a change before reloading.
+var watchDebounce = time.Second
+
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_CREATE | syscall.IN_DELETE
+
+// configWatcher watches the directories of the config files with inotify.
+// Watching the directories (rather than the files) catches editors and deploy tools
+// replacing files by renaming.
+type configWatcher struct {
+	filename string
+	reload   func()   // reloads the daemon
+	fd       int      // for adding watches. Calling Fd() on the file would make it blocking.
+	inotify  *os.File // for reading events
+
+	mu      sync.Mutex
+	watches map[int32]string // watch descriptor -> directory
+	files   map[string]bool  // config files
+	dirs    map[string]bool  // directories where all config files are loaded
+}
+
+// watchConfig starts watching the config file(s) and calls reload when they change.
+// Call the returned function to stop watching.
+func watchConfig(filename string, reload func()) (stop func(), err error) {
+
+	fd, err := syscall.InotifyInit1(syscall.IN_NONBLOCK | syscall.IN_CLOEXEC)
+	if err != nil {
+		return
+	}
+	w := &configWatcher{
+		filename: filename,
+		reload:   reload,
+		fd:       fd,
+		inotify:  os.NewFile(uintptr(fd), "inotify"),
+		watches:  make(map[int32]string),
+	}
+
+	err = w.update()
+	if err != nil {
+		w.inotify.Close()
+		return
+	}
+
+	events := make(chan struct{})
+	done := make(chan struct{})
+	go w.read(events)
+	go func() {
+		defer close(done)
+		w.debounce(events)
+	}()
+
+	stop = func() {
+		w.inotify.Close()
+		<-done
+	}
+	return
+}
+
+// update (re)reads the config to find the files to watch.
+func (w *configWatcher) update() error {
+	cfg, err := parseConfigSpec(w.filename)
+	if err != nil {
+		return err
+	}
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	watch := make(map[string]bool)
+	for _, file := range cfg.Files() {
+		abs, err := filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+		files[abs] = true
+		watch[filepath.Dir(abs)] = true
+	}
+	for _, dir := range cfg.Dirs() {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+		dirs[abs] = true
+		watch[abs] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.files, w.dirs = files, dirs
+
+	// Adding a watch for an already watched directory returns the same descriptor.
+	watched := make(map[int32]string)
+	for dir := range watch {
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, watchMask)
+		if err != nil {
+			return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+		}
+		watched[int32(wd)] = dir
+	}
+	for wd := range w.watches {
+		if _, ok := watched[wd]; !ok {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+		}
+	}
+	w.watches = watched
+	return nil
+}
+
+// read signals events for config files until the inotify file is closed.
+func (w *configWatcher) read(events chan<- struct{}) {
+	defer close(events)
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.inotify.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[nameStart:nameStart+int(event.Len)], "\x00"))
+			offset = nameStart + int(event.Len)
+
+			if w.isConfigEvent(event.Wd, name) {
+				events <- struct{}{}
+			}
+		}
+	}
+}
+
+// isConfigEvent tells whether an event in a watched directory concerns the config.
+func (w *configWatcher) isConfigEvent(wd int32, name string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	dir, ok := w.watches[wd]
+	if !ok || name == "" {
+		return false
+	}
+	path := filepath.Join(dir, name)
+	return w.files[path] || (w.dirs[dir] && config.IsConfigFile(name))
+}
+
+// debounce waits for config changes to settle and then reloads.
+func (w *configWatcher) debounce(events <-chan struct{}) {
+	var timer *time.Timer
+	var fire <-chan time.Time
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+			if timer == nil {
+				timer = time.NewTimer(watchDebounce)
+			} else {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(watchDebounce)
+			}
+			fire = timer.C
+		case <-fire:
+			fire = nil
+			w.changed()
+		}
+	}
+}
+
+// changed updates the files to watch and reloads the daemon.
+// The reload configures everything from the files before replacing the running servers,
+// so a broken or half written config file is reported and doesn't take down serving.
+// Validating the files separately first would not ensure the reload reads the same.
+func (w *configWatcher) changed() {
+	log.NOTICE("Config changed. Reloading", "file", w.filename)
+	err := w.update()
+	if err != nil {
+		log.ERROR("Failed to watch config files", "file", w.filename, "err", err)
+	}
+	w.reload()
+}
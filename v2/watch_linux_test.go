@@ -0,0 +1,63 @@
+package ozone
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchConfig(t *testing.T) {
+	defer func(d time.Duration) { watchDebounce = d }(watchDebounce)
+	watchDebounce = 10 * time.Millisecond
+
+	dir := t.TempDir()
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("ozone.json", `{ "Include" : [ "handlers.json" ] }`)
+	write("handlers.json", `{ "Handlers" : {} }`)
+
+	reloads := make(chan struct{}, 10)
+	stop, err := watchConfig(filepath.Join(dir, "ozone.json"), func() { reloads <- struct{}{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	expect := func(reload bool, what string) {
+		t.Helper()
+		select {
+		case <-reloads:
+			if !reload {
+				t.Errorf("Reloaded when %s", what)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if reload {
+				t.Errorf("No reload when %s", what)
+			}
+		}
+	}
+
+	write("handlers.json", `{ "Handlers" : { "a" : { "Type" : "Redirect" } } }`)
+	expect(true, "changing an included file")
+
+	write("other.json", `{}`)
+	expect(false, "writing a file not in the config")
+
+	// Files included by the changed config are watched.
+	write("ozone.json", `{ "Include" : [ "other.json" ] }`)
+	expect(true, "changing the config file")
+	write("other.json", `{ "Handlers" : {} }`)
+	expect(true, "changing a newly included file")
+
+	// Replacing by rename counts.
+	write("ozone.json.tmp", `{}`)
+	if err = os.Rename(filepath.Join(dir, "ozone.json.tmp"), filepath.Join(dir, "ozone.json")); err != nil {
+		t.Fatal(err)
+	}
+	expect(true, "replacing the config file")
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package ozone
+
+import "errors"
+
+// watchConfig is only implemented on Linux (using inotify).
+func watchConfig(filename string, reload func()) (stop func(), err error) {
+	return nil, errors.New("Watching config files is not supported on this platform")
+}